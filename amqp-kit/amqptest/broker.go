@@ -0,0 +1,434 @@
+// Package amqptest provides an in-memory AMQP broker for unit tests of amqp-kit clients and subscribers.
+//
+// The broker supports direct, fanout, topic and headers exchanges, durable and transient
+// queues, prefetch, ack/nack/requeue, message TTL, dead-lettering, publisher confirms,
+// mandatory returns and RabbitMQ direct reply-to.
+//
+//	b := amqptest.NewBroker()
+//	client, err := amqp_kit.New(cfg, amqp_kit.ClientDialer(b.Dial))
+package amqptest
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	amqp_kit "github.com/space307/go-utils/v3/amqp-kit"
+	"github.com/streadway/amqp"
+)
+
+const (
+	deadLetterExchangeArg = "x-dead-letter-exchange"
+	deadLetterKeyArg      = "x-dead-letter-routing-key"
+	messageTTLArg         = "x-message-ttl"
+	maxLengthArg          = "x-max-length"
+)
+
+// Broker is an in-memory AMQP broker, the zero value is not usable, see NewBroker
+type Broker struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	exchanges map[string]*exchange
+	queues    map[string]*queue
+	conns     map[*Connection]struct{}
+	seq       uint64
+}
+
+type exchange struct {
+	name       string
+	kind       string
+	durable    bool
+	autoDelete bool
+	internal   bool
+	bindings   []binding
+}
+
+type binding struct {
+	queue string
+	key   string
+	args  amqp.Table
+}
+
+type queue struct {
+	name              string
+	durable           bool
+	autoDelete        bool
+	exclusive         bool
+	owner             *Connection
+	args              amqp.Table
+	messages          []*message
+	consumers         int
+	exclusiveConsumer bool // has an exclusive consumer
+}
+
+type message struct {
+	exchange    string
+	key         string
+	pub         amqp.Publishing
+	redelivered bool
+	expires     time.Time
+}
+
+// NewBroker creates a broker with the default and amq.* exchanges
+func NewBroker() *Broker {
+	b := &Broker{
+		exchanges: make(map[string]*exchange),
+		queues:    make(map[string]*queue),
+		conns:     make(map[*Connection]struct{}),
+	}
+	b.cond = sync.NewCond(&b.mu)
+
+	b.exchanges[""] = &exchange{kind: amqp.ExchangeDirect, durable: true}
+	for _, kind := range []string{amqp.ExchangeDirect, amqp.ExchangeFanout, amqp.ExchangeTopic, amqp.ExchangeHeaders} {
+		b.exchanges["amq."+kind] = &exchange{name: "amq." + kind, kind: kind, durable: true}
+	}
+
+	return b
+}
+
+// Dial opens a connection to the broker, config and address are ignored.
+// It is an amqp_kit.Dialer.
+func (b *Broker) Dial(_ *amqp_kit.Config, _ string) (amqp_kit.AMQPConnection, error) {
+	return b.Connect(), nil
+}
+
+// Connect opens a connection to the broker
+func (b *Broker) Connect() *Connection {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	conn := &Connection{b: b, channels: make(map[*Channel]struct{})}
+	b.conns[conn] = struct{}{}
+	return conn
+}
+
+// Channel opens a channel on a new connection, it may be used as amqp_kit.Channel for Subscriber.ServeDelivery
+func (b *Broker) Channel() *Channel {
+	ch, _ := b.Connect().channel()
+	return ch
+}
+
+// Publish routes the message as if it was published by a client
+func (b *Broker) Publish(exchange, key string, msg amqp.Publishing) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ex, ok := b.exchanges[exchange]
+	if !ok {
+		return newError(amqp.NotFound, "NOT_FOUND - no exchange '%s'", exchange)
+	}
+	b.route(ex, key, msg)
+	b.cond.Broadcast()
+
+	return nil
+}
+
+// Get removes the first ready message of the queue, ok is false if there are no messages.
+// The delivery has no Acknowledger.
+func (b *Broker) Get(queue string) (d amqp.Delivery, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	q, exists := b.queues[queue]
+	if !exists {
+		return d, false
+	}
+	b.expire(q)
+	if len(q.messages) == 0 {
+		return d, false
+	}
+
+	m := q.messages[0]
+	q.messages = q.messages[1:]
+	return m.delivery(nil, "", 0), true
+}
+
+// QueueLen returns the number of ready messages in the queue
+func (b *Broker) QueueLen(queue string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	q, ok := b.queues[queue]
+	if !ok {
+		return 0
+	}
+	b.expire(q)
+	return len(q.messages)
+}
+
+// Restart emulates a broker restart: connections are closed with CONNECTION_FORCED,
+// transient exchanges, queues and messages are lost.
+func (b *Broker) Restart() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for conn := range b.conns {
+		conn.close(newError(amqp.ConnectionForced, "CONNECTION_FORCED - broker forced connection closure with reason 'shutdown'"))
+	}
+
+	for name, ex := range b.exchanges {
+		if !ex.durable {
+			delete(b.exchanges, name)
+		}
+	}
+	for _, q := range b.queues {
+		if !q.durable {
+			b.deleteQueue(q)
+			continue
+		}
+
+		persistent := q.messages[:0]
+		for _, m := range q.messages {
+			if m.pub.DeliveryMode == amqp.Persistent {
+				persistent = append(persistent, m)
+			}
+		}
+		q.messages = persistent
+	}
+	b.cond.Broadcast()
+}
+
+func (b *Broker) nextName(prefix string) string {
+	b.seq++
+	return prefix + strconv.FormatUint(b.seq, 10)
+}
+
+func (b *Broker) deleteQueue(q *queue) {
+	delete(b.queues, q.name)
+	for _, ex := range b.exchanges {
+		bindings := ex.bindings[:0]
+		for _, bind := range ex.bindings {
+			if bind.queue != q.name {
+				bindings = append(bindings, bind)
+			}
+		}
+		ex.bindings = bindings
+	}
+}
+
+// route enqueues the message to every queue bound to the exchange by the key, returns false if unroutable
+func (b *Broker) route(ex *exchange, key string, pub amqp.Publishing) bool {
+	var names []string
+	if ex.name == "" {
+		names = []string{key}
+	} else {
+		seen := make(map[string]struct{})
+		for _, bind := range ex.bindings {
+			if _, ok := seen[bind.queue]; ok || !ex.matches(bind, key, pub.Headers) {
+				continue
+			}
+			seen[bind.queue] = struct{}{}
+			names = append(names, bind.queue)
+		}
+	}
+
+	routed := false
+	for _, name := range names {
+		if q, ok := b.queues[name]; ok {
+			b.enqueue(q, &message{exchange: ex.name, key: key, pub: copyPublishing(pub)})
+			routed = true
+		}
+	}
+
+	return routed
+}
+
+func (b *Broker) enqueue(q *queue, m *message) {
+	ttl, ok := int64Arg(q.args[messageTTLArg])
+	if exp, err := strconv.ParseInt(m.pub.Expiration, 10, 64); err == nil && (!ok || exp < ttl) {
+		ttl, ok = exp, true
+	}
+	if ok {
+		d := time.Duration(ttl) * time.Millisecond
+		m.expires = time.Now().Add(d)
+		time.AfterFunc(d, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+
+			if b.queues[q.name] == q {
+				b.expire(q)
+			}
+		})
+	}
+
+	q.messages = append(q.messages, m)
+
+	if max, ok := int64Arg(q.args[maxLengthArg]); ok {
+		for int64(len(q.messages)) > max {
+			head := q.messages[0]
+			q.messages = q.messages[1:]
+			b.deadLetter(q, head, "maxlen")
+		}
+	}
+}
+
+// requeue puts messages back to the head of the queue keeping their order
+func (b *Broker) requeue(q *queue, ms []*message) {
+	for _, m := range ms {
+		m.redelivered = true
+	}
+	q.messages = append(ms, q.messages...)
+}
+
+// expire dead-letters messages with elapsed TTL
+func (b *Broker) expire(q *queue) {
+	now := time.Now()
+	alive := q.messages[:0]
+	var expired []*message
+	for _, m := range q.messages {
+		if !m.expires.IsZero() && !now.Before(m.expires) {
+			expired = append(expired, m)
+			continue
+		}
+		alive = append(alive, m)
+	}
+	q.messages = alive
+
+	for _, m := range expired {
+		b.deadLetter(q, m, "expired")
+	}
+	if len(expired) > 0 {
+		b.cond.Broadcast()
+	}
+}
+
+// deadLetter republishes the message to the dead letter exchange of the queue or drops it
+func (b *Broker) deadLetter(q *queue, m *message, reason string) {
+	dlx, ok := q.args[deadLetterExchangeArg].(string)
+	if !ok {
+		return
+	}
+	ex, ok := b.exchanges[dlx]
+	if !ok {
+		return
+	}
+
+	key := m.key
+	if k, ok := q.args[deadLetterKeyArg].(string); ok {
+		key = k
+	}
+
+	pub := copyPublishing(m.pub)
+	pub.Expiration = ""
+
+	deaths, _ := pub.Headers["x-death"].([]interface{})
+	pub.Headers["x-death"] = append([]interface{}{amqp.Table{
+		"queue":        q.name,
+		"reason":       reason,
+		"exchange":     m.exchange,
+		"routing-keys": []interface{}{m.key},
+		"count":        int64(1),
+		"time":         time.Now(),
+	}}, deaths...)
+	if _, ok := pub.Headers["x-first-death-queue"]; !ok {
+		pub.Headers["x-first-death-queue"] = q.name
+		pub.Headers["x-first-death-reason"] = reason
+		pub.Headers["x-first-death-exchange"] = m.exchange
+	}
+
+	b.route(ex, key, pub)
+}
+
+func (ex *exchange) matches(bind binding, key string, headers amqp.Table) bool {
+	switch ex.kind {
+	case amqp.ExchangeFanout:
+		return true
+	case amqp.ExchangeTopic:
+		return amqp_kit.MatchTopic(bind.key, key)
+	case amqp.ExchangeHeaders:
+		return amqp_kit.MatchHeaders(bind.args, headers)
+	default:
+		return bind.key == key
+	}
+}
+
+func (m *message) delivery(ack amqp.Acknowledger, consumerTag string, tag uint64) amqp.Delivery {
+	p := m.pub
+	return amqp.Delivery{
+		Acknowledger:    ack,
+		Headers:         copyTable(p.Headers),
+		ContentType:     p.ContentType,
+		ContentEncoding: p.ContentEncoding,
+		DeliveryMode:    p.DeliveryMode,
+		Priority:        p.Priority,
+		CorrelationId:   p.CorrelationId,
+		ReplyTo:         p.ReplyTo,
+		Expiration:      p.Expiration,
+		MessageId:       p.MessageId,
+		Timestamp:       p.Timestamp,
+		Type:            p.Type,
+		UserId:          p.UserId,
+		AppId:           p.AppId,
+		ConsumerTag:     consumerTag,
+		DeliveryTag:     tag,
+		Redelivered:     m.redelivered,
+		Exchange:        m.exchange,
+		RoutingKey:      m.key,
+		Body:            p.Body,
+	}
+}
+
+func newReturn(exchange, key string, p amqp.Publishing) *amqp.Return {
+	return &amqp.Return{
+		ReplyCode:       amqp.NoRoute,
+		ReplyText:       "NO_ROUTE",
+		Exchange:        exchange,
+		RoutingKey:      key,
+		ContentType:     p.ContentType,
+		ContentEncoding: p.ContentEncoding,
+		Headers:         copyTable(p.Headers),
+		DeliveryMode:    p.DeliveryMode,
+		Priority:        p.Priority,
+		CorrelationId:   p.CorrelationId,
+		ReplyTo:         p.ReplyTo,
+		Expiration:      p.Expiration,
+		MessageId:       p.MessageId,
+		Timestamp:       p.Timestamp,
+		Type:            p.Type,
+		UserId:          p.UserId,
+		AppId:           p.AppId,
+		Body:            p.Body,
+	}
+}
+
+func copyPublishing(p amqp.Publishing) amqp.Publishing {
+	p.Headers = copyTable(p.Headers)
+	return p
+}
+
+func copyTable(t amqp.Table) amqp.Table {
+	c := make(amqp.Table, len(t))
+	for k, v := range t {
+		c[k] = v
+	}
+	return c
+}
+
+func int64Arg(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int16:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	}
+	return 0, false
+}
+
+func sortedTags(m map[uint64]*delivery) []uint64 {
+	tags := make([]uint64, 0, len(m))
+	for tag := range m {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	return tags
+}
+
+func newError(code int, format string, args ...interface{}) *amqp.Error {
+	return &amqp.Error{Code: code, Reason: fmt.Sprintf(format, args...), Server: true}
+}
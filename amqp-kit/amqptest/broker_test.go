@@ -0,0 +1,742 @@
+package amqptest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	amqp_kit "github.com/space307/go-utils/v3/amqp-kit"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouting(t *testing.T) {
+	b := NewBroker()
+	ch := b.Channel()
+
+	require.NoError(t, ch.ExchangeDeclare("topic", amqp.ExchangeTopic, true, false, false, false, nil))
+	require.NoError(t, ch.ExchangeDeclare("fanout", amqp.ExchangeFanout, true, false, false, false, nil))
+	require.NoError(t, ch.ExchangeDeclare("headers", amqp.ExchangeHeaders, true, false, false, false, nil))
+	for _, q := range []string{"q1", "q2"} {
+		_, err := ch.QueueDeclare(q, true, false, false, false, nil)
+		require.NoError(t, err)
+		require.NoError(t, ch.QueueBind(q, "", "fanout", false, nil))
+	}
+	require.NoError(t, ch.QueueBind("q1", "order.*", "topic", false, nil))
+	require.NoError(t, ch.QueueBind("q2", "#", "topic", false, nil))
+	require.NoError(t, ch.QueueBind("q2", "", "headers", false, amqp.Table{"x-match": "any", "kind": "a"}))
+
+	require.NoError(t, b.Publish("topic", "order.created", amqp.Publishing{}))
+	require.NoError(t, b.Publish("topic", "user.created", amqp.Publishing{}))
+	require.NoError(t, b.Publish("fanout", "any", amqp.Publishing{}))
+	require.NoError(t, b.Publish("headers", "", amqp.Publishing{Headers: amqp.Table{"kind": "a"}}))
+	require.NoError(t, b.Publish("headers", "", amqp.Publishing{Headers: amqp.Table{"kind": "b"}}))
+	require.NoError(t, b.Publish("", "q1", amqp.Publishing{}))
+
+	assert.Equal(t, 3, b.QueueLen("q1"))
+	assert.Equal(t, 4, b.QueueLen("q2"))
+
+	d, ok := b.Get("q1")
+	require.True(t, ok)
+	assert.Equal(t, "topic", d.Exchange)
+	assert.Equal(t, "order.created", d.RoutingKey)
+
+	assert.Error(t, b.Publish("unknown", "", amqp.Publishing{}))
+}
+
+func TestAckNack(t *testing.T) {
+	b := NewBroker()
+	ch := b.Channel()
+
+	_, err := ch.QueueDeclare("dlq", true, false, false, false, nil)
+	require.NoError(t, err)
+	_, err = ch.QueueDeclare("q", true, false, false, false, amqp.Table{"x-dead-letter-exchange": "", "x-dead-letter-routing-key": "dlq"})
+	require.NoError(t, err)
+	require.NoError(t, ch.Qos(1, 0, false))
+
+	msgs, err := ch.Consume("q", "", false, false, false, false, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, b.Publish("", "q", amqp.Publishing{Body: []byte("1")}))
+	require.NoError(t, b.Publish("", "q", amqp.Publishing{Body: []byte("2")}))
+
+	d := <-msgs
+	assert.Equal(t, []byte("1"), d.Body)
+	assert.False(t, d.Redelivered)
+	// prefetch holds the second message
+	assert.Equal(t, 1, b.QueueLen("q"))
+
+	require.NoError(t, d.Nack(false, true))
+	d = <-msgs
+	assert.Equal(t, []byte("1"), d.Body)
+	assert.True(t, d.Redelivered)
+
+	require.NoError(t, d.Reject(false))
+	d = <-msgs
+	assert.Equal(t, []byte("2"), d.Body)
+	require.NoError(t, d.Ack(false))
+
+	dead, ok := b.Get("dlq")
+	require.True(t, ok)
+	assert.Equal(t, []byte("1"), dead.Body)
+	assert.Equal(t, "q", dead.Headers["x-first-death-queue"])
+	assert.Equal(t, "rejected", dead.Headers["x-first-death-reason"])
+
+	// double ack is a channel error
+	err = d.Ack(false)
+	require.Error(t, err)
+	assert.Equal(t, amqp.PreconditionFailed, err.(*amqp.Error).Code)
+	_, ok = <-msgs
+	assert.False(t, ok)
+}
+
+func TestCloseRequeues(t *testing.T) {
+	b := NewBroker()
+	ch := b.Channel()
+
+	_, err := ch.QueueDeclare("q", true, false, false, false, nil)
+	require.NoError(t, err)
+	msgs, err := ch.Consume("q", "", false, false, false, false, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, b.Publish("", "q", amqp.Publishing{}))
+	<-msgs
+
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+	require.NoError(t, ch.Close())
+	_, ok := <-closed
+	assert.False(t, ok)
+
+	d, ok := b.Get("q")
+	require.True(t, ok)
+	assert.True(t, d.Redelivered)
+}
+
+func TestMessageTTL(t *testing.T) {
+	b := NewBroker()
+	ch := b.Channel()
+
+	_, err := ch.QueueDeclare("target", true, false, false, false, nil)
+	require.NoError(t, err)
+	_, err = ch.QueueDeclare("delay", true, false, false, false, amqp.Table{
+		"x-message-ttl":             int64(10),
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": "target",
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, b.Publish("", "delay", amqp.Publishing{Body: []byte("late")}))
+	assert.Equal(t, 1, b.QueueLen("delay"))
+
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, 0, b.QueueLen("delay"))
+
+	d, ok := b.Get("target")
+	require.True(t, ok)
+	assert.Equal(t, []byte("late"), d.Body)
+	assert.Equal(t, "expired", d.Headers["x-first-death-reason"])
+}
+
+func TestRestart(t *testing.T) {
+	b := NewBroker()
+	conn := b.Connect()
+	closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	ch, err := conn.Channel()
+	require.NoError(t, err)
+
+	_, err = ch.QueueDeclare("durable", true, false, false, false, nil)
+	require.NoError(t, err)
+	_, err = ch.QueueDeclare("transient", false, false, false, false, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, b.Publish("", "durable", amqp.Publishing{DeliveryMode: amqp.Persistent}))
+	require.NoError(t, b.Publish("", "durable", amqp.Publishing{DeliveryMode: amqp.Transient}))
+	require.NoError(t, b.Publish("", "transient", amqp.Publishing{DeliveryMode: amqp.Persistent}))
+
+	b.Restart()
+
+	err = <-closed
+	require.NotNil(t, err)
+	assert.Equal(t, amqp.ConnectionForced, err.(*amqp.Error).Code)
+	assert.Equal(t, 1, b.QueueLen("durable"))
+
+	_, err = b.Channel().QueueInspect("transient")
+	assert.Error(t, err)
+}
+
+func TestClient(t *testing.T) {
+	b := NewBroker()
+	client, err := amqp_kit.New(&amqp_kit.Config{Address: "amqptest", PublishConfirm: true}, amqp_kit.ClientDialer(b.Dial))
+	require.NoError(t, err)
+	defer client.Close()
+
+	received := make(chan string, 1)
+	pooled := make(chan string, 8)
+	err = client.Serve([]amqp_kit.SubscribeInfo{
+		{
+			Queue:       "test_pool",
+			Exchange:    "events",
+			Concurrency: 4,
+			Ordering:    amqp_kit.OrderPerKey,
+			E: func(ctx context.Context, request interface{}) (interface{}, error) {
+				pooled <- request.(string)
+				return nil, nil
+			},
+			Dec: func(ctx context.Context, d *amqp.Delivery) (interface{}, error) { return string(d.Body), nil },
+			Enc: amqp_kit.EncodeNopResponse,
+			O:   []amqp_kit.SubscriberOption{amqp_kit.SubscriberAfter(amqp_kit.SetAckAfterEndpoint(false))},
+		},
+		{
+			Queue:    "test_events",
+			Exchange: "events",
+			E: func(ctx context.Context, request interface{}) (interface{}, error) {
+				received <- request.(string)
+				return nil, nil
+			},
+			Dec: func(ctx context.Context, d *amqp.Delivery) (interface{}, error) { return string(d.Body), nil },
+			Enc: amqp_kit.EncodeNopResponse,
+		},
+		{
+			Queue:    "test_rpc",
+			Exchange: "events",
+			E: func(ctx context.Context, request interface{}) (interface{}, error) {
+				return amqp_kit.Response{Data: "pong"}, nil
+			},
+			Dec: func(ctx context.Context, d *amqp.Delivery) (interface{}, error) { return nil, nil },
+			Enc: amqp_kit.EncodeJSONResponse,
+		},
+		{
+			Queue:    "test_retry",
+			Exchange: "events",
+			E: func(ctx context.Context, request interface{}) (interface{}, error) {
+				return nil, errors.New("failed")
+			},
+			Dec: func(ctx context.Context, d *amqp.Delivery) (interface{}, error) { return nil, nil },
+			Enc: amqp_kit.EncodeNopResponse,
+			O: []amqp_kit.SubscriberOption{
+				amqp_kit.SubscriberRetry(amqp_kit.RetryPolicy{MaxAttempts: 3, Delay: 5 * time.Millisecond}),
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, client.Publish("events", "test.events", "", []byte("hello")))
+	select {
+	case body := <-received:
+		assert.Equal(t, "hello", body)
+	case <-time.After(time.Second):
+		t.Fatal("message is not received")
+	}
+
+	for i := 0; i < 8; i++ {
+		require.NoError(t, client.Publish("events", "test.pool", "", []byte("pooled")))
+	}
+	for i := 0; i < 8; i++ {
+		select {
+		case <-pooled:
+		case <-time.After(time.Second):
+			t.Fatal("pooled message is not received")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	data, err := client.Call(ctx, "events", "test.rpc", []byte("ping"))
+	require.NoError(t, err)
+	assert.Equal(t, json.RawMessage(`"pong"`), data)
+
+	require.NoError(t, client.Publish("events", "test.retry", "", []byte("retry")))
+	deadline := time.Now().Add(time.Second)
+	for b.QueueLen("test_retry.parking") == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	parked, ok := b.Get("test_retry.parking")
+	require.True(t, ok)
+	assert.Equal(t, []byte("retry"), parked.Body)
+	assert.Equal(t, int32(3), parked.Headers[amqp_kit.RetryAttemptsHeader])
+}
+
+func TestClientSubscribe(t *testing.T) {
+	b := NewBroker()
+	client, err := amqp_kit.New(&amqp_kit.Config{Address: "amqptest", ReconnectAfterDuration: 10 * time.Millisecond}, amqp_kit.ClientDialer(b.Dial))
+	require.NoError(t, err)
+	defer client.Close()
+
+	received := make(chan string, 1)
+	si := amqp_kit.SubscribeInfo{
+		Queue:    "tenant_1",
+		Exchange: "tenants",
+		E: func(ctx context.Context, request interface{}) (interface{}, error) {
+			received <- request.(string)
+			return nil, nil
+		},
+		Dec: func(ctx context.Context, d *amqp.Delivery) (interface{}, error) { return string(d.Body), nil },
+		Enc: amqp_kit.EncodeNopResponse,
+		O:   []amqp_kit.SubscriberOption{amqp_kit.SubscriberAfter(amqp_kit.SetAckAfterEndpoint(false))},
+	}
+
+	sub, err := client.Subscribe(si)
+	require.NoError(t, err)
+	assert.Equal(t, amqp_kit.SubscriptionActive, sub.Status().State)
+
+	_, err = client.Subscribe(si)
+	assert.Error(t, err)
+
+	b.Restart()
+	deadline := time.Now().Add(3 * time.Second)
+	for sub.Status().Restarts == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	status := sub.Status()
+	assert.Equal(t, amqp_kit.SubscriptionActive, status.State)
+	assert.Equal(t, 1, status.Restarts)
+
+	require.NoError(t, client.Publish("tenants", "tenant.1", "", []byte("after restart")))
+	select {
+	case body := <-received:
+		assert.Equal(t, "after restart", body)
+	case <-time.After(time.Second):
+		t.Fatal("message is not received")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, sub.Cancel(ctx))
+	assert.Equal(t, amqp_kit.SubscriptionCancelled, sub.Status().State)
+	assert.Equal(t, 0, sub.Status().Consumers)
+
+	require.NoError(t, client.Publish("tenants", "tenant.1", "", []byte("after cancel")))
+	assert.Equal(t, 1, b.QueueLen("tenant_1"))
+
+	// the queue may be subscribed again
+	sub, err = client.Subscribe(si)
+	require.NoError(t, err)
+	select {
+	case body := <-received:
+		assert.Equal(t, "after cancel", body)
+	case <-time.After(time.Second):
+		t.Fatal("message is not received")
+	}
+	require.NoError(t, sub.Cancel(ctx))
+}
+
+func TestClientRetryOptionShared(t *testing.T) {
+	b := NewBroker()
+	client, err := amqp_kit.New(&amqp_kit.Config{Address: "amqptest"}, amqp_kit.ClientDialer(b.Dial))
+	require.NoError(t, err)
+	defer client.Close()
+
+	retry := amqp_kit.SubscriberRetry(amqp_kit.RetryPolicy{MaxAttempts: 2, Delay: 5 * time.Millisecond})
+	subscribeInfo := func(queue string) amqp_kit.SubscribeInfo {
+		return amqp_kit.SubscribeInfo{
+			Queue:    queue,
+			Exchange: "events",
+			Workers:  2,
+			E: func(ctx context.Context, request interface{}) (interface{}, error) {
+				return nil, errors.New("failed")
+			},
+			Dec: func(ctx context.Context, d *amqp.Delivery) (interface{}, error) { return nil, nil },
+			Enc: amqp_kit.EncodeNopResponse,
+			O:   []amqp_kit.SubscriberOption{retry},
+		}
+	}
+	require.NoError(t, client.Serve([]amqp_kit.SubscribeInfo{subscribeInfo("retry_qa"), subscribeInfo("retry_qb")}))
+
+	require.NoError(t, client.Publish("events", "retry.qa", "", []byte("a")))
+	require.NoError(t, client.Publish("events", "retry.qb", "", []byte("b")))
+
+	// every queue parks its own message
+	for queue, body := range map[string]string{"retry_qa.parking": "a", "retry_qb.parking": "b"} {
+		deadline := time.Now().Add(time.Second)
+		for b.QueueLen(queue) == 0 && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		parked, ok := b.Get(queue)
+		require.True(t, ok, queue)
+		assert.Equal(t, body, string(parked.Body))
+	}
+}
+
+func TestClientShutdownConsumers(t *testing.T) {
+	b := NewBroker()
+	var restored int32
+	client, err := amqp_kit.New(&amqp_kit.Config{Address: "amqptest", ShutdownTimeout: 5 * time.Second},
+		amqp_kit.ClientDialer(b.Dial),
+		amqp_kit.OnConsumerRestored(func(queue string) { atomic.AddInt32(&restored, 1) }),
+	)
+	require.NoError(t, err)
+
+	started := make(chan struct{}, 1)
+	err = client.Serve([]amqp_kit.SubscribeInfo{{
+		Queue:    "shutdown_q",
+		Exchange: "events",
+		Workers:  2,
+		E: func(ctx context.Context, request interface{}) (interface{}, error) {
+			started <- struct{}{}
+			time.Sleep(1500 * time.Millisecond)
+			return nil, nil
+		},
+		Dec: func(ctx context.Context, d *amqp.Delivery) (interface{}, error) { return nil, nil },
+		Enc: amqp_kit.EncodeNopResponse,
+		O:   []amqp_kit.SubscriberOption{amqp_kit.SubscriberAfter(amqp_kit.SetAckAfterEndpoint(false))},
+	}})
+	require.NoError(t, err)
+
+	require.NoError(t, client.Publish("events", "shutdown.q", "", []byte("slow")))
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("message is not received")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, client.Shutdown(ctx))
+	// cancelled consumers are not restored while draining
+	assert.Equal(t, int32(0), atomic.LoadInt32(&restored))
+}
+
+func TestClientSubscribeFirstStart(t *testing.T) {
+	b := NewBroker()
+	var restored int32
+	client, err := amqp_kit.New(&amqp_kit.Config{Address: "amqptest", WaitWorkerDuration: 3 * time.Second},
+		amqp_kit.ClientDialer(b.Dial),
+		amqp_kit.OnConsumerRestored(func(queue string) { atomic.AddInt32(&restored, 1) }),
+	)
+	require.NoError(t, err)
+	defer client.Close()
+
+	// the first declare fails while another connection holds the queue
+	owner := b.Connect()
+	ch, err := owner.Channel()
+	require.NoError(t, err)
+	_, err = ch.QueueDeclare("first_start_q", true, false, true, false, nil)
+	require.NoError(t, err)
+	time.AfterFunc(200*time.Millisecond, func() { _ = owner.Close() })
+
+	sub, err := client.Subscribe(amqp_kit.SubscribeInfo{
+		Queue:    "first_start_q",
+		Exchange: "events",
+		E:        func(ctx context.Context, request interface{}) (interface{}, error) { return nil, nil },
+		Dec:      func(ctx context.Context, d *amqp.Delivery) (interface{}, error) { return nil, nil },
+		Enc:      amqp_kit.EncodeNopResponse,
+	})
+	require.NoError(t, err)
+
+	status := sub.Status()
+	assert.Equal(t, 1, status.Consumers)
+	assert.Equal(t, 0, status.Restarts)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&restored))
+}
+
+func TestClientHeadersExchange(t *testing.T) {
+	b := NewBroker()
+	client, err := amqp_kit.New(&amqp_kit.Config{
+		Address:   "amqptest",
+		Exchanges: map[string]amqp_kit.ExchangeInfo{"documents": {Kind: amqp.ExchangeHeaders}},
+	}, amqp_kit.ClientDialer(b.Dial))
+	require.NoError(t, err)
+	defer client.Close()
+
+	received := make(chan string, 2)
+	endpoint := func(name string) func(ctx context.Context, request interface{}) (interface{}, error) {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			received <- name + ":" + request.(string)
+			return nil, nil
+		}
+	}
+	dec := func(ctx context.Context, d *amqp.Delivery) (interface{}, error) { return string(d.Body), nil }
+
+	err = client.Serve([]amqp_kit.SubscribeInfo{{
+		Queue:    "documents",
+		Exchange: "documents",
+		BindArgs: amqp.Table{"format": "pdf"},
+		E:        endpoint("pdf"),
+		Dec:      dec,
+		Enc:      amqp_kit.EncodeNopResponse,
+		O:        []amqp_kit.SubscriberOption{amqp_kit.SubscriberAfter(amqp_kit.SetAckAfterEndpoint(false))},
+		Routes: []amqp_kit.Route{{
+			BindArgs: amqp.Table{"x-match": "any", "format": "zip", "archive": true},
+			E:        endpoint("zip"),
+			Dec:      dec,
+		}},
+	}})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.NoError(t, client.PublishWithOptions(ctx, "documents", "", []byte("1"), amqp_kit.PublishHeaders(amqp.Table{"format": "pdf"})))
+	require.NoError(t, client.PublishWithOptions(ctx, "documents", "", []byte("2"), amqp_kit.PublishHeaders(amqp.Table{"archive": true})))
+	// not bound, so it is not routed to the queue
+	require.NoError(t, client.PublishWithOptions(ctx, "documents", "", []byte("3"), amqp_kit.PublishHeaders(amqp.Table{"format": "doc"})))
+
+	var got []string
+	for i := 0; i < 2; i++ {
+		select {
+		case r := <-received:
+			got = append(got, r)
+		case <-time.After(time.Second):
+			t.Fatal("message is not received")
+		}
+	}
+	assert.ElementsMatch(t, []string{"pdf:1", "zip:2"}, got)
+	assert.Equal(t, 0, b.QueueLen("documents"))
+}
+
+func TestClientServeError(t *testing.T) {
+	b := NewBroker()
+	client, err := amqp_kit.New(&amqp_kit.Config{Address: "amqptest"}, amqp_kit.ClientDialer(b.Dial))
+	require.NoError(t, err)
+	defer client.Close()
+
+	subscribeInfo := func(queue string) amqp_kit.SubscribeInfo {
+		return amqp_kit.SubscribeInfo{
+			Queue:    queue,
+			Exchange: "events",
+			E:        func(ctx context.Context, request interface{}) (interface{}, error) { return nil, nil },
+			Dec:      func(ctx context.Context, d *amqp.Delivery) (interface{}, error) { return nil, nil },
+			Enc:      amqp_kit.EncodeNopResponse,
+		}
+	}
+
+	sub, err := client.Subscribe(subscribeInfo("serve_taken"))
+	require.NoError(t, err)
+
+	// the subscription started before the error is cancelled
+	err = client.Serve([]amqp_kit.SubscribeInfo{subscribeInfo("serve_first"), subscribeInfo("serve_taken")})
+	assert.Error(t, err)
+	queues := client.Health().Queues
+	require.Len(t, queues, 1)
+	assert.Equal(t, "serve_taken", queues[0].Queue)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, sub.Cancel(ctx))
+	require.NoError(t, client.Serve([]amqp_kit.SubscribeInfo{subscribeInfo("serve_first"), subscribeInfo("serve_taken")}))
+}
+
+func TestClientOutboundBuffer(t *testing.T) {
+	b := NewBroker()
+	_, err := b.Channel().QueueDeclare("outbox", true, false, false, false, nil)
+	require.NoError(t, err)
+
+	var down int32
+	dial := func(c *amqp_kit.Config, addr string) (amqp_kit.AMQPConnection, error) {
+		if atomic.LoadInt32(&down) == 1 {
+			return nil, errors.New("connection refused")
+		}
+		return b.Dial(c, addr)
+	}
+	client, err := amqp_kit.New(&amqp_kit.Config{
+		Address:                "amqptest",
+		ReconnectAfterDuration: 10 * time.Millisecond,
+		OutboundBuffer:         2,
+		OutboundBufferPolicy:   amqp_kit.BufferFail,
+	}, amqp_kit.ClientDialer(dial))
+	require.NoError(t, err)
+	defer client.Close()
+
+	atomic.StoreInt32(&down, 1)
+	b.Restart()
+	deadline := time.Now().Add(3 * time.Second)
+	for client.State() != amqp_kit.StateReconnecting && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	require.NoError(t, client.Publish("", "outbox", "", []byte("1")))
+	require.NoError(t, client.Publish("", "outbox", "", []byte("2")))
+	assert.Equal(t, amqp_kit.ErrBufferFull, client.Publish("", "outbox", "", []byte("3")))
+	assert.Equal(t, 2, client.BufferDepth())
+	assert.Equal(t, 0, b.QueueLen("outbox"))
+
+	atomic.StoreInt32(&down, 0)
+	deadline = time.Now().Add(3 * time.Second)
+	for client.BufferDepth() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, 2, b.QueueLen("outbox"))
+	for _, body := range []string{"1", "2"} {
+		d, _ := b.Get("outbox")
+		assert.Equal(t, body, string(d.Body))
+	}
+}
+
+func TestClientShutdownFlushesBuffer(t *testing.T) {
+	b := NewBroker()
+	_, err := b.Channel().QueueDeclare("outbox", true, false, false, false, nil)
+	require.NoError(t, err)
+
+	var down int32
+	dial := func(c *amqp_kit.Config, addr string) (amqp_kit.AMQPConnection, error) {
+		if atomic.LoadInt32(&down) == 1 {
+			return nil, errors.New("connection refused")
+		}
+		return b.Dial(c, addr)
+	}
+	client, err := amqp_kit.New(&amqp_kit.Config{
+		Address:                "amqptest",
+		ReconnectAfterDuration: 10 * time.Millisecond,
+		OutboundBuffer:         1,
+	}, amqp_kit.ClientDialer(dial))
+	require.NoError(t, err)
+
+	atomic.StoreInt32(&down, 1)
+	b.Restart()
+	deadline := time.Now().Add(3 * time.Second)
+	for client.State() != amqp_kit.StateReconnecting && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.NoError(t, client.Publish("", "outbox", "", []byte("1")))
+
+	// the full buffer blocks until the publish context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, client.PublishWithOptions(ctx, "", "outbox", []byte("2")))
+
+	// the client keeps reconnecting while the buffer is drained
+	time.AfterFunc(50*time.Millisecond, func() { atomic.StoreInt32(&down, 0) })
+	ctx, cancel = context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	require.NoError(t, client.Shutdown(ctx))
+	assert.Equal(t, 1, b.QueueLen("outbox"))
+}
+
+func TestClientMandatory(t *testing.T) {
+	b := NewBroker()
+	_, err := b.Channel().QueueDeclare("routed", true, false, false, false, nil)
+	require.NoError(t, err)
+
+	client, err := amqp_kit.New(&amqp_kit.Config{Address: "amqptest", PublishConfirm: true, PublishMandatory: true}, amqp_kit.ClientDialer(b.Dial))
+	require.NoError(t, err)
+	defer client.Close()
+
+	assert.NoError(t, client.Publish("", "routed", "", []byte("1")))
+	assert.Equal(t, amqp_kit.ErrUnroutable, client.Publish("", "typo", "", []byte("2")))
+	assert.NoError(t, client.Publish("", "routed", "", []byte("3")))
+	assert.Equal(t, 2, b.QueueLen("routed"))
+
+	returned := make(chan amqp.Return, 1)
+	client, err = amqp_kit.New(&amqp_kit.Config{Address: "amqptest", PublishMandatory: true}, amqp_kit.ClientDialer(b.Dial),
+		amqp_kit.OnReturn(func(r amqp.Return) { returned <- r }))
+	require.NoError(t, err)
+	defer client.Close()
+
+	require.NoError(t, client.Publish("", "typo", "cor", []byte("4")))
+	select {
+	case r := <-returned:
+		assert.Equal(t, uint16(amqp.NoRoute), r.ReplyCode)
+		assert.Equal(t, "typo", r.RoutingKey)
+		assert.Equal(t, "cor", r.CorrelationId)
+		assert.Equal(t, "4", string(r.Body))
+	case <-time.After(time.Second):
+		t.Fatal("message is not returned")
+	}
+}
+
+func TestClientHealth(t *testing.T) {
+	b := NewBroker()
+	client, err := amqp_kit.New(&amqp_kit.Config{Address: "amqptest"}, amqp_kit.ClientDialer(b.Dial))
+	require.NoError(t, err)
+	defer client.Close()
+
+	release := make(chan struct{})
+	sub, err := client.Subscribe(amqp_kit.SubscribeInfo{
+		Queue:      "health",
+		Exchange:   "health",
+		Prefetch:   1,
+		MaxBacklog: 1,
+		E: func(ctx context.Context, request interface{}) (interface{}, error) {
+			<-release
+			return nil, nil
+		},
+		Dec: func(ctx context.Context, d *amqp.Delivery) (interface{}, error) { return nil, nil },
+		Enc: amqp_kit.EncodeNopResponse,
+	})
+	require.NoError(t, err)
+
+	check := amqp_kit.HealthCheckup(client)
+	require.NoError(t, check())
+
+	h := client.Health()
+	assert.Equal(t, amqp_kit.StateConnected, h.State)
+	assert.Equal(t, "amqptest", h.Node)
+	assert.True(t, h.SinceConnect > 0)
+	assert.Equal(t, []amqp_kit.QueueHealth{{Queue: "health", Expected: 1, Running: 1, Consumers: 1, MaxBacklog: 1}}, h.Queues)
+
+	// at most one message is handled, others are waiting
+	for i := 0; i < 3; i++ {
+		require.NoError(t, client.Publish("health", "health", "", []byte("msg")))
+	}
+	err = check()
+	require.Error(t, err)
+	assert.Regexp(t, `^AMQP: unhealthy: queue health backlog [23] exceeds 1$`, err.Error())
+	close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, sub.Cancel(ctx))
+	assert.Empty(t, client.Health().Queues)
+}
+
+func TestBacklogExporter(t *testing.T) {
+	b := NewBroker()
+	_, err := b.Channel().QueueDeclare("backlog_extra", true, false, false, false, nil)
+	require.NoError(t, err)
+
+	client, err := amqp_kit.New(&amqp_kit.Config{Address: "amqptest"}, amqp_kit.ClientDialer(b.Dial))
+	require.NoError(t, err)
+	defer client.Close()
+
+	sub, err := client.Subscribe(amqp_kit.SubscribeInfo{
+		Queue:    "backlog_consumed",
+		Exchange: "backlog",
+		E:        func(ctx context.Context, request interface{}) (interface{}, error) { return nil, nil },
+		Dec:      func(ctx context.Context, d *amqp.Delivery) (interface{}, error) { return nil, nil },
+		Enc:      amqp_kit.EncodeNopResponse,
+	})
+	require.NoError(t, err)
+	defer sub.Cancel(context.Background())
+
+	events := make(chan amqp_kit.BacklogEvent, 2)
+	e := amqp_kit.NewBacklogExporter(client,
+		amqp_kit.BacklogQueue("backlog_extra", 2),
+		amqp_kit.BacklogMetrics(amqp_kit.NewMetrics()),
+		amqp_kit.OnBacklog(func(ev amqp_kit.BacklogEvent) { events <- ev }))
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, b.Publish("", "backlog_extra", amqp.Publishing{Body: []byte("msg")}))
+	}
+	e.Collect()
+	select {
+	case ev := <-events:
+		assert.Equal(t, "backlog_extra", ev.Queue)
+		assert.Equal(t, 3, ev.Messages)
+		assert.True(t, ev.Exceeded)
+	default:
+		t.Fatal("backlog event is not raised")
+	}
+
+	req, err := http.NewRequest("", "", nil)
+	require.NoError(t, err)
+	rec := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(rec, req)
+	assert.Contains(t, rec.Body.String(), `amqp_queue_messages{queue="backlog_extra"} 3`)
+	assert.Contains(t, rec.Body.String(), `amqp_queue_consumers{queue="backlog_consumed"} 1`)
+
+	b.Get("backlog_extra")
+	b.Get("backlog_extra")
+	e.Collect()
+	select {
+	case ev := <-events:
+		assert.Equal(t, 1, ev.Messages)
+		assert.False(t, ev.Exceeded)
+	default:
+		t.Fatal("backlog event is not raised")
+	}
+}
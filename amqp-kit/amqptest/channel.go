@@ -0,0 +1,704 @@
+package amqptest
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+
+	amqp_kit "github.com/space307/go-utils/v3/amqp-kit"
+	"github.com/streadway/amqp"
+)
+
+// Connection is a connection to Broker, it implements amqp_kit.AMQPConnection
+type Connection struct {
+	b        *Broker
+	channels map[*Channel]struct{}
+	closed   bool
+	notify   notifier
+	blocked  []chan amqp.Blocking
+}
+
+// Channel is a channel of Connection, it implements amqp_kit.AMQPChannel and amqp.Acknowledger
+type Channel struct {
+	b         *Broker
+	conn      *Connection
+	closed    bool
+	prefetch  int
+	nextTag   uint64
+	unacked   map[uint64]*delivery
+	consumers map[string]*consumer
+	confirm   bool
+	published uint64
+	replyTo   string
+	notify    notifier
+}
+
+// delivery is a message delivered and not settled yet
+type delivery struct {
+	queue    *queue
+	msg      *message
+	consumer *consumer
+}
+
+type consumer struct {
+	ch         *Channel
+	tag        string
+	queue      *queue
+	autoAck    bool
+	prefetch   int
+	unacked    int
+	cancelled  bool
+	deliveries chan amqp.Delivery
+	done       chan struct{}
+}
+
+// notifier sends close errors, publish confirms and returns to listeners outside of the broker lock
+type notifier struct {
+	lock     sync.Mutex
+	closed   bool
+	close    []chan *amqp.Error
+	confirms []chan amqp.Confirmation
+	returns  []chan amqp.Return
+}
+
+func (n *notifier) notifyClose(c chan *amqp.Error) chan *amqp.Error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.closed {
+		close(c)
+		return c
+	}
+	n.close = append(n.close, c)
+	return c
+}
+
+func (n *notifier) notifyPublish(c chan amqp.Confirmation) chan amqp.Confirmation {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.closed {
+		close(c)
+		return c
+	}
+	n.confirms = append(n.confirms, c)
+	return c
+}
+
+func (n *notifier) notifyReturn(c chan amqp.Return) chan amqp.Return {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.closed {
+		close(c)
+		return c
+	}
+	n.returns = append(n.returns, c)
+	return c
+}
+
+func (n *notifier) ret(r amqp.Return) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.closed {
+		return
+	}
+	for _, l := range n.returns {
+		l <- r
+	}
+}
+
+func (n *notifier) confirm(c amqp.Confirmation) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.closed {
+		return
+	}
+	for _, l := range n.confirms {
+		l <- c
+	}
+}
+
+func (n *notifier) shutdown(err *amqp.Error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.closed {
+		return
+	}
+	n.closed = true
+
+	for _, l := range n.close {
+		if err != nil {
+			l <- err
+		}
+		close(l)
+	}
+	for _, l := range n.confirms {
+		close(l)
+	}
+	for _, l := range n.returns {
+		close(l)
+	}
+}
+
+// Channel opens a channel
+func (c *Connection) Channel() (amqp_kit.AMQPChannel, error) {
+	ch, err := c.channel()
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+func (c *Connection) channel() (*Channel, error) {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+
+	if c.closed {
+		return nil, amqp.ErrClosed
+	}
+
+	ch := &Channel{
+		b:         c.b,
+		conn:      c,
+		unacked:   make(map[uint64]*delivery),
+		consumers: make(map[string]*consumer),
+	}
+	c.channels[ch] = struct{}{}
+	return ch, nil
+}
+
+// NotifyClose registers a listener for the connection close, see amqp.Connection.NotifyClose
+func (c *Connection) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	return c.notify.notifyClose(receiver)
+}
+
+// NotifyBlocked registers a listener for blocked notifications, the broker never blocks connections
+func (c *Connection) NotifyBlocked(receiver chan amqp.Blocking) chan amqp.Blocking {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+
+	if c.closed {
+		close(receiver)
+		return receiver
+	}
+	c.blocked = append(c.blocked, receiver)
+	return receiver
+}
+
+// Close closes the connection and its channels, unacked messages are requeued
+func (c *Connection) Close() error {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+
+	if c.closed {
+		return amqp.ErrClosed
+	}
+	c.close(nil)
+	return nil
+}
+
+func (c *Connection) close(err *amqp.Error) {
+	c.closed = true
+	for ch := range c.channels {
+		ch.close(err)
+	}
+	for _, q := range c.b.queues {
+		if q.exclusive && q.owner == c {
+			c.b.deleteQueue(q)
+		}
+	}
+	delete(c.b.conns, c)
+
+	for _, l := range c.blocked {
+		close(l)
+	}
+	c.blocked = nil
+	go c.notify.shutdown(err)
+}
+
+// ExchangeDeclare declares an exchange, see amqp.Channel.ExchangeDeclare
+func (ch *Channel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	ch.b.mu.Lock()
+	defer ch.b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+
+	if ex, ok := ch.b.exchanges[name]; ok {
+		if ex.kind != kind || ex.durable != durable {
+			return ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - inequivalent arg 'type' or 'durable' for exchange '%s'", name)
+		}
+		return nil
+	}
+
+	if name == "" || strings.HasPrefix(name, "amq.") {
+		return ch.fail(amqp.AccessRefused, "ACCESS_REFUSED - exchange name '%s' contains reserved prefix 'amq.*'", name)
+	}
+
+	switch kind {
+	case amqp.ExchangeDirect, amqp.ExchangeFanout, amqp.ExchangeTopic, amqp.ExchangeHeaders:
+	default:
+		return ch.fail(amqp.CommandInvalid, "COMMAND_INVALID - invalid exchange type '%s'", kind)
+	}
+
+	ch.b.exchanges[name] = &exchange{name: name, kind: kind, durable: durable, autoDelete: autoDelete, internal: internal}
+	return nil
+}
+
+// QueueDeclare declares a queue, an empty name generates a unique one, see amqp.Channel.QueueDeclare
+func (ch *Channel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	ch.b.mu.Lock()
+	defer ch.b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+
+	if name == "" {
+		name = ch.b.nextName("amq.gen-")
+	}
+
+	if q, ok := ch.b.queues[name]; ok {
+		if q.exclusive && q.owner != ch.conn {
+			return amqp.Queue{}, ch.fail(amqp.ResourceLocked, "RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s'", name)
+		}
+		if q.durable != durable {
+			return amqp.Queue{}, ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - inequivalent arg 'durable' for queue '%s'", name)
+		}
+		return q.inspect(), nil
+	}
+
+	q := &queue{
+		name:       name,
+		durable:    durable,
+		autoDelete: autoDelete,
+		exclusive:  exclusive,
+		args:       copyTable(args),
+	}
+	if exclusive {
+		q.owner = ch.conn
+	}
+	ch.b.queues[name] = q
+
+	return q.inspect(), nil
+}
+
+// QueueInspect returns the state of the queue, see amqp.Channel.QueueInspect
+func (ch *Channel) QueueInspect(name string) (amqp.Queue, error) {
+	ch.b.mu.Lock()
+	defer ch.b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+
+	q, ok := ch.b.queues[name]
+	if !ok {
+		return amqp.Queue{}, ch.fail(amqp.NotFound, "NOT_FOUND - no queue '%s'", name)
+	}
+	ch.b.expire(q)
+
+	return q.inspect(), nil
+}
+
+// QueueBind binds the queue to the exchange, see amqp.Channel.QueueBind
+func (ch *Channel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	ch.b.mu.Lock()
+	defer ch.b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+
+	if exchange == "" {
+		return ch.fail(amqp.AccessRefused, "ACCESS_REFUSED - operation not permitted on the default exchange")
+	}
+	ex, ok := ch.b.exchanges[exchange]
+	if !ok {
+		return ch.fail(amqp.NotFound, "NOT_FOUND - no exchange '%s'", exchange)
+	}
+	if _, ok := ch.b.queues[name]; !ok {
+		return ch.fail(amqp.NotFound, "NOT_FOUND - no queue '%s'", name)
+	}
+
+	for _, bind := range ex.bindings {
+		if bind.queue == name && bind.key == key && reflect.DeepEqual(bind.args, copyTable(args)) {
+			return nil
+		}
+	}
+	ex.bindings = append(ex.bindings, binding{queue: name, key: key, args: copyTable(args)})
+
+	return nil
+}
+
+// Qos sets prefetch count for consumers started after the call, prefetch size is ignored
+func (ch *Channel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	ch.b.mu.Lock()
+	defer ch.b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.prefetch = prefetchCount
+
+	return nil
+}
+
+// Confirm puts the channel into confirm mode, every publishing is acked
+func (ch *Channel) Confirm(noWait bool) error {
+	ch.b.mu.Lock()
+	defer ch.b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.confirm = true
+
+	return nil
+}
+
+// NotifyPublish registers a listener for publisher confirms, see amqp.Channel.NotifyPublish
+func (ch *Channel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	return ch.notify.notifyPublish(confirm)
+}
+
+// NotifyReturn registers a listener for unroutable mandatory publishings, see amqp.Channel.NotifyReturn
+func (ch *Channel) NotifyReturn(c chan amqp.Return) chan amqp.Return {
+	return ch.notify.notifyReturn(c)
+}
+
+// NotifyClose registers a listener for the channel close, see amqp.Channel.NotifyClose
+func (ch *Channel) NotifyClose(c chan *amqp.Error) chan *amqp.Error {
+	return ch.notify.notifyClose(c)
+}
+
+// Publish routes the message. ReplyTo amq.rabbitmq.reply-to is replaced by the reply queue
+// of the channel, so the channel must consume it before.
+func (ch *Channel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	ch.b.mu.Lock()
+
+	if ch.closed {
+		ch.b.mu.Unlock()
+		return amqp.ErrClosed
+	}
+
+	ex, ok := ch.b.exchanges[exchange]
+	if !ok {
+		err := ch.fail(amqp.NotFound, "NOT_FOUND - no exchange '%s'", exchange)
+		ch.b.mu.Unlock()
+		return err
+	}
+	if ex.internal {
+		err := ch.fail(amqp.AccessRefused, "ACCESS_REFUSED - cannot publish to internal exchange '%s'", exchange)
+		ch.b.mu.Unlock()
+		return err
+	}
+
+	if msg.ReplyTo == amqp_kit.DirectReplyTo {
+		if ch.replyTo == "" {
+			err := ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - fast reply consumer does not exist")
+			ch.b.mu.Unlock()
+			return err
+		}
+		msg.ReplyTo = ch.replyTo
+	}
+
+	routed := ch.b.route(ex, key, msg)
+	ch.b.cond.Broadcast()
+
+	var ret *amqp.Return
+	if mandatory && !routed {
+		ret = newReturn(exchange, key, msg)
+	}
+
+	var confirm *amqp.Confirmation
+	if ch.confirm {
+		ch.published++
+		confirm = &amqp.Confirmation{DeliveryTag: ch.published, Ack: true}
+	}
+	ch.b.mu.Unlock()
+
+	// the return is sent before the confirm as by RabbitMQ
+	if ret != nil {
+		ch.notify.ret(*ret)
+	}
+	if confirm != nil {
+		ch.notify.confirm(*confirm)
+	}
+
+	return nil
+}
+
+// Consume starts a consumer of the queue, see amqp.Channel.Consume.
+// Consuming amq.rabbitmq.reply-to enables direct reply-to for the channel and requires autoAck.
+func (ch *Channel) Consume(name, consumerTag string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	ch.b.mu.Lock()
+	defer ch.b.mu.Unlock()
+
+	if ch.closed {
+		return nil, amqp.ErrClosed
+	}
+
+	if name == amqp_kit.DirectReplyTo {
+		if !autoAck {
+			return nil, ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - reply consumer cannot acknowledge")
+		}
+		if ch.replyTo == "" {
+			ch.replyTo = ch.b.nextName(amqp_kit.DirectReplyTo + ".")
+			ch.b.queues[ch.replyTo] = &queue{name: ch.replyTo, exclusive: true, autoDelete: true, owner: ch.conn}
+		}
+		name = ch.replyTo
+	}
+
+	q, ok := ch.b.queues[name]
+	if !ok {
+		return nil, ch.fail(amqp.NotFound, "NOT_FOUND - no queue '%s'", name)
+	}
+	if q.exclusiveConsumer || exclusive && q.consumers > 0 {
+		return nil, ch.fail(amqp.AccessRefused, "ACCESS_REFUSED - queue '%s' in exclusive use", name)
+	}
+
+	if consumerTag == "" {
+		consumerTag = ch.b.nextName("amq.ctag-")
+	}
+	if _, ok := ch.consumers[consumerTag]; ok {
+		return nil, ch.fail(amqp.NotAllowed, "NOT_ALLOWED - attempt to reuse consumer tag '%s'", consumerTag)
+	}
+
+	c := &consumer{
+		ch:         ch,
+		tag:        consumerTag,
+		queue:      q,
+		autoAck:    autoAck,
+		prefetch:   ch.prefetch,
+		deliveries: make(chan amqp.Delivery),
+		done:       make(chan struct{}),
+	}
+	ch.consumers[consumerTag] = c
+	q.consumers++
+	q.exclusiveConsumer = exclusive
+
+	go ch.b.serve(c)
+
+	return c.deliveries, nil
+}
+
+// Cancel stops the consumer, the delivery channel is closed after all deliveries are read
+func (ch *Channel) Cancel(consumer string, noWait bool) error {
+	ch.b.mu.Lock()
+	defer ch.b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+
+	if c, ok := ch.consumers[consumer]; ok {
+		ch.cancel(c)
+	}
+
+	return nil
+}
+
+// Close closes the channel, unacked messages are requeued
+func (ch *Channel) Close() error {
+	ch.b.mu.Lock()
+	defer ch.b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.close(nil)
+
+	return nil
+}
+
+// Ack acknowledges the delivery, an unknown tag closes the channel as RabbitMQ does
+func (ch *Channel) Ack(tag uint64, multiple bool) error {
+	ch.b.mu.Lock()
+	defer ch.b.mu.Unlock()
+
+	ds, err := ch.settle(tag, multiple)
+	if err != nil {
+		return err
+	}
+	for _, d := range ds {
+		d.consumer.unacked--
+	}
+	ch.b.cond.Broadcast()
+
+	return nil
+}
+
+// Nack rejects the delivery, it is requeued or dead-lettered
+func (ch *Channel) Nack(tag uint64, multiple bool, requeue bool) error {
+	ch.b.mu.Lock()
+	defer ch.b.mu.Unlock()
+
+	ds, err := ch.settle(tag, multiple)
+	if err != nil {
+		return err
+	}
+
+	ch.reject(ds, requeue)
+	ch.b.cond.Broadcast()
+
+	return nil
+}
+
+// Reject rejects the delivery, it is requeued or dead-lettered
+func (ch *Channel) Reject(tag uint64, requeue bool) error {
+	return ch.Nack(tag, false, requeue)
+}
+
+// settle removes unacked deliveries up to the tag, ordered by tag
+func (ch *Channel) settle(tag uint64, multiple bool) ([]*delivery, error) {
+	if ch.closed {
+		return nil, amqp.ErrClosed
+	}
+
+	if _, ok := ch.unacked[tag]; !ok {
+		return nil, ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - unknown delivery tag %d", tag)
+	}
+
+	var ds []*delivery
+	for _, t := range sortedTags(ch.unacked) {
+		if t == tag || multiple && t < tag {
+			ds = append(ds, ch.unacked[t])
+			delete(ch.unacked, t)
+		}
+	}
+
+	return ds, nil
+}
+
+func (ch *Channel) reject(ds []*delivery, requeue bool) {
+	byQueue := make(map[*queue][]*message)
+	for _, d := range ds {
+		d.consumer.unacked--
+		if !requeue {
+			ch.b.deadLetter(d.queue, d.msg, "rejected")
+			continue
+		}
+		byQueue[d.queue] = append(byQueue[d.queue], d.msg)
+	}
+
+	for q, ms := range byQueue {
+		if ch.b.queues[q.name] == q {
+			ch.b.requeue(q, ms)
+		}
+	}
+}
+
+func (ch *Channel) cancel(c *consumer) {
+	if c.cancelled {
+		return
+	}
+	c.cancelled = true
+	close(c.done)
+	delete(ch.consumers, c.tag)
+
+	q := c.queue
+	q.consumers--
+	q.exclusiveConsumer = false
+	if q.autoDelete && q.consumers == 0 && ch.b.queues[q.name] == q {
+		ch.b.deleteQueue(q)
+	}
+	ch.b.cond.Broadcast()
+}
+
+// fail closes the channel with the error, as the broker does on a channel exception
+func (ch *Channel) fail(code int, format string, args ...interface{}) error {
+	err := newError(code, format, args...)
+	ch.close(err)
+	return err
+}
+
+func (ch *Channel) close(err *amqp.Error) {
+	if ch.closed {
+		return
+	}
+
+	for _, c := range ch.consumers {
+		ch.cancel(c)
+	}
+
+	ds := make([]*delivery, 0, len(ch.unacked))
+	for _, tag := range sortedTags(ch.unacked) {
+		ds = append(ds, ch.unacked[tag])
+	}
+	ch.unacked = make(map[uint64]*delivery)
+	ch.reject(ds, true)
+
+	ch.closed = true
+	delete(ch.conn.channels, ch)
+	ch.b.cond.Broadcast()
+
+	go ch.notify.shutdown(err)
+}
+
+// serve sends ready messages of the queue to the consumer while it is not cancelled
+func (b *Broker) serve(c *consumer) {
+	defer close(c.deliveries)
+
+	for {
+		b.mu.Lock()
+		for !c.cancelled && !c.ready() {
+			b.cond.Wait()
+		}
+		if c.cancelled {
+			b.mu.Unlock()
+			return
+		}
+
+		q := c.queue
+		m := q.messages[0]
+		q.messages = q.messages[1:]
+
+		c.ch.nextTag++
+		tag := c.ch.nextTag
+		if !c.autoAck {
+			c.ch.unacked[tag] = &delivery{queue: q, msg: m, consumer: c}
+			c.unacked++
+		}
+		d := m.delivery(c.ch, c.tag, tag)
+		b.mu.Unlock()
+
+		select {
+		case c.deliveries <- d:
+		case <-c.done:
+			// the message was not delivered, return it to the queue
+			b.mu.Lock()
+			if _, ok := c.ch.unacked[tag]; ok {
+				delete(c.ch.unacked, tag)
+				c.unacked--
+				if b.queues[q.name] == q {
+					q.messages = append([]*message{m}, q.messages...)
+				}
+			} else if c.autoAck && b.queues[q.name] == q {
+				q.messages = append([]*message{m}, q.messages...)
+			}
+			b.cond.Broadcast()
+			b.mu.Unlock()
+			return
+		}
+	}
+}
+
+// ready reports if a message may be delivered to the consumer, the broker lock must be held
+func (c *consumer) ready() bool {
+	if c.prefetch > 0 && c.unacked >= c.prefetch {
+		return false
+	}
+
+	c.ch.b.expire(c.queue)
+	return len(c.queue.messages) > 0
+}
+
+func (q *queue) inspect() amqp.Queue {
+	return amqp.Queue{Name: q.name, Messages: len(q.messages), Consumers: q.consumers}
+}
@@ -0,0 +1,94 @@
+// Package amqptls contains amqps and EXTERNAL auth settings shared by amqp-kit and messagebus.
+package amqptls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	defaultHeartbeat = 10 * time.Second
+	defaultLocale    = "en_US"
+)
+
+// Config struct contains settings of amqps connection.
+// CAFile is the private CA bundle, system roots are used if empty.
+// CertFile and KeyFile are the client certificate, used by the EXTERNAL mechanism.
+type Config struct {
+	CAFile     string
+	CertFile   string
+	KeyFile    string
+	ServerName string
+	MinVersion uint16
+}
+
+// Build creates tls.Config from the settings
+func (t *Config) Build() (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName: t.ServerName,
+		MinVersion: t.MinVersion,
+	}
+
+	if t.CAFile != "" {
+		ca, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("amqptls: read CA file err: %s", err)
+		}
+
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("amqptls: no certificates in CA file %s", t.CAFile)
+		}
+	}
+
+	if t.CertFile != "" || t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("amqptls: load client certificate err: %s", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// ExternalAuth is the EXTERNAL SASL mechanism, the broker takes the identity
+// from the client certificate
+type ExternalAuth struct{}
+
+// Mechanism returns "EXTERNAL"
+func (ExternalAuth) Mechanism() string {
+	return "EXTERNAL"
+}
+
+// Response returns empty response, the identity is not sent
+func (ExternalAuth) Response() string {
+	return ""
+}
+
+// DialConfig creates amqp.Config with TLS settings and EXTERNAL mechanism if external is set
+func DialConfig(t *Config, external bool) (amqp.Config, error) {
+	cfg := amqp.Config{
+		Heartbeat: defaultHeartbeat,
+		Locale:    defaultLocale,
+	}
+
+	if t != nil {
+		tlsCfg, err := t.Build()
+		if err != nil {
+			return cfg, err
+		}
+		cfg.TLSClientConfig = tlsCfg
+	}
+
+	if external {
+		cfg.SASL = []amqp.Authentication{ExternalAuth{}}
+	}
+
+	return cfg, nil
+}
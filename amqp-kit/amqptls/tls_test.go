@@ -0,0 +1,44 @@
+package amqptls
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialConfig(t *testing.T) {
+	cfg, err := DialConfig(nil, false)
+	require.NoError(t, err)
+	assert.Nil(t, cfg.TLSClientConfig)
+	assert.Nil(t, cfg.SASL)
+
+	cfg, err = DialConfig(&Config{ServerName: "rabbit", MinVersion: tls.VersionTLS12}, true)
+	require.NoError(t, err)
+	assert.Equal(t, "rabbit", cfg.TLSClientConfig.ServerName)
+	assert.Equal(t, uint16(tls.VersionTLS12), cfg.TLSClientConfig.MinVersion)
+	assert.Equal(t, []amqp.Authentication{ExternalAuth{}}, cfg.SASL)
+	assert.Equal(t, "EXTERNAL", cfg.SASL[0].Mechanism())
+}
+
+func TestConfigBuildErrors(t *testing.T) {
+	_, err := (&Config{CAFile: "not_exists.pem"}).Build()
+	assert.Error(t, err)
+
+	f, err := ioutil.TempFile("", "ca")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("not a certificate")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	_, err = (&Config{CAFile: f.Name()}).Build()
+	assert.Error(t, err)
+
+	_, err = (&Config{CertFile: "not_exists.pem", KeyFile: "not_exists.key"}).Build()
+	assert.Error(t, err)
+}
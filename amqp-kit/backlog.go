@@ -0,0 +1,204 @@
+package amqp_kit
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/space307/go-utils/v3/sg"
+	"github.com/streadway/amqp"
+)
+
+const defaultBacklogInterval = 15 * time.Second
+
+var (
+	// BacklogExporter must satisfy the sg.Server interface.
+	_ sg.Server = (*BacklogExporter)(nil)
+)
+
+// BacklogEvent is raised when the backlog of a queue stays above MaxBacklog for the
+// BacklogDuration and when it drops below MaxBacklog again
+type BacklogEvent struct {
+	Queue      string
+	Messages   int
+	MaxBacklog int
+	// Since is the time of the first collection with the backlog above MaxBacklog
+	Since time.Time
+	// Exceeded is false when the backlog has dropped below MaxBacklog
+	Exceeded bool
+}
+
+// BacklogOption sets an optional parameter for backlog exporters.
+type BacklogOption func(*BacklogExporter)
+
+// BacklogInterval sets the interval of inspecting queues
+func BacklogInterval(d time.Duration) BacklogOption {
+	return func(e *BacklogExporter) { e.interval = d }
+}
+
+// BacklogDuration sets how long the backlog stays above MaxBacklog before an event is raised
+func BacklogDuration(d time.Duration) BacklogOption {
+	return func(e *BacklogExporter) { e.duration = d }
+}
+
+// BacklogQueue adds a queue not consumed by the client, zero maxBacklog means no events
+func BacklogQueue(queue string, maxBacklog int) BacklogOption {
+	return func(e *BacklogExporter) { e.queues[queue] = maxBacklog }
+}
+
+// OnBacklog sets the handler of backlog events, by default events are logged
+func OnBacklog(f func(e BacklogEvent)) BacklogOption {
+	return func(e *BacklogExporter) { e.onBacklog = f }
+}
+
+// BacklogMetrics sets collectors of queue gauges, the client metrics or NewMetrics are used by default
+func BacklogMetrics(m *Metrics) BacklogOption {
+	return func(e *BacklogExporter) { e.metrics = m }
+}
+
+// BacklogExporter inspects queues consumed by the client and added by BacklogQueue,
+// exports ready messages and consumers as gauges and raises backlog events
+// for queues with SubscribeInfo.MaxBacklog or BacklogQueue thresholds.
+type BacklogExporter struct {
+	client    *Client
+	interval  time.Duration
+	duration  time.Duration
+	queues    map[string]int
+	onBacklog func(e BacklogEvent)
+	metrics   *Metrics
+	lock      sync.Mutex
+	since     map[string]time.Time
+	raised    map[string]bool
+	stop      chan struct{}
+	stopOnce  sync.Once
+}
+
+// NewBacklogExporter creates an exporter of queues of the client
+func NewBacklogExporter(c *Client, opts ...BacklogOption) *BacklogExporter {
+	e := &BacklogExporter{
+		client:   c,
+		interval: defaultBacklogInterval,
+		queues:   make(map[string]int),
+		metrics:  c.metrics,
+		since:    make(map[string]time.Time),
+		raised:   make(map[string]bool),
+		stop:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	if e.metrics == nil {
+		e.metrics = NewMetrics()
+	}
+
+	return e
+}
+
+// Serve collects queues every interval until Stop is called
+func (e *BacklogExporter) Serve() error {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		e.Collect()
+
+		select {
+		case <-e.stop:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stop stops collecting
+func (e *BacklogExporter) Stop() error {
+	e.stopOnce.Do(func() { close(e.stop) })
+	return nil
+}
+
+// Collect inspects queues once, exports gauges and raises backlog events
+func (e *BacklogExporter) Collect() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	queues, thresholds := e.targets()
+	now := time.Now()
+
+	var events []BacklogEvent
+	e.client.inspectQueues(queues, func(i int, info amqp.Queue, err error) {
+		queue := queues[i]
+		if err != nil {
+			log.Warnf("AMQP: inspect queue %s err %v", queue, err)
+			return
+		}
+
+		e.metrics.queue(queue, info.Messages, info.Consumers)
+		if ev, ok := e.check(queue, info.Messages, thresholds[i], now); ok {
+			events = append(events, ev)
+		}
+	})
+
+	for _, ev := range events {
+		e.raise(ev)
+	}
+}
+
+// targets returns consumed and added queues with their thresholds
+func (e *BacklogExporter) targets() ([]string, []int) {
+	var (
+		queues     []string
+		thresholds []int
+	)
+	for _, s := range e.client.subscriptions() {
+		if _, ok := e.queues[s.si.Queue]; ok {
+			continue
+		}
+		queues = append(queues, s.si.Queue)
+		thresholds = append(thresholds, s.si.MaxBacklog)
+	}
+	for queue, max := range e.queues {
+		queues = append(queues, queue)
+		thresholds = append(thresholds, max)
+	}
+
+	return queues, thresholds
+}
+
+// check tracks the backlog of the queue and returns an event on a change
+func (e *BacklogExporter) check(queue string, messages, max int, now time.Time) (BacklogEvent, bool) {
+	ev := BacklogEvent{Queue: queue, Messages: messages, MaxBacklog: max}
+
+	if max == 0 || messages <= max {
+		ev.Since = e.since[queue]
+		raised := e.raised[queue]
+		delete(e.since, queue)
+		delete(e.raised, queue)
+		return ev, raised
+	}
+
+	since, ok := e.since[queue]
+	if !ok {
+		since = now
+		e.since[queue] = since
+	}
+	ev.Since, ev.Exceeded = since, true
+
+	if e.raised[queue] || now.Sub(since) < e.duration {
+		return ev, false
+	}
+	e.raised[queue] = true
+	return ev, true
+}
+
+func (e *BacklogExporter) raise(ev BacklogEvent) {
+	if e.onBacklog != nil {
+		e.onBacklog(ev)
+		return
+	}
+
+	if ev.Exceeded {
+		log.Warnf("AMQP: queue %s backlog %d exceeds %d since %s", ev.Queue, ev.Messages, ev.MaxBacklog, ev.Since)
+		return
+	}
+	log.Infof("AMQP: queue %s backlog %d is below %d", ev.Queue, ev.Messages, ev.MaxBacklog)
+}
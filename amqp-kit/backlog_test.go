@@ -0,0 +1,38 @@
+package amqp_kit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBacklogCheck(t *testing.T) {
+	e := NewBacklogExporter(&Client{}, BacklogDuration(time.Minute))
+	start := time.Now()
+
+	_, ok := e.check(`q`, 5, 0, start)
+	assert.False(t, ok)
+	_, ok = e.check(`q`, 11, 10, start)
+	assert.False(t, ok)
+	_, ok = e.check(`q`, 12, 10, start.Add(30*time.Second))
+	assert.False(t, ok)
+
+	ev, ok := e.check(`q`, 13, 10, start.Add(time.Minute))
+	assert.True(t, ok)
+	assert.Equal(t, BacklogEvent{Queue: `q`, Messages: 13, MaxBacklog: 10, Since: start, Exceeded: true}, ev)
+
+	// the event is raised once
+	_, ok = e.check(`q`, 14, 10, start.Add(2*time.Minute))
+	assert.False(t, ok)
+
+	ev, ok = e.check(`q`, 3, 10, start.Add(3*time.Minute))
+	assert.True(t, ok)
+	assert.Equal(t, BacklogEvent{Queue: `q`, Messages: 3, MaxBacklog: 10, Since: start}, ev)
+
+	// a short backlog is not reported
+	_, ok = e.check(`q`, 11, 10, start.Add(4*time.Minute))
+	assert.False(t, ok)
+	_, ok = e.check(`q`, 1, 10, start.Add(5*time.Minute))
+	assert.False(t, ok)
+}
@@ -0,0 +1,234 @@
+package amqp_kit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// BufferPolicy is the behavior of Publish when the outbound buffer is full
+type BufferPolicy int
+
+const (
+	// BufferBlock waits until the buffer has room, the client is closed or the publish context is done
+	BufferBlock BufferPolicy = iota
+	// BufferDropOldest drops the oldest buffered message
+	BufferDropOldest
+	// BufferFail returns ErrBufferFull
+	BufferFail
+)
+
+const (
+	bufferDrainInterval = 10 * time.Millisecond
+	// bufferPublishAttempts limits publishing of a buffered message while connected
+	bufferPublishAttempts = 3
+)
+
+// outbound is a message waiting for the connection
+type outbound struct {
+	seq      uint64
+	exchange string
+	key      string
+	pub      amqp.Publishing
+}
+
+// buffer keeps messages published while the client is reconnecting and flushes them in order
+type buffer struct {
+	lock     sync.Mutex
+	size     int
+	policy   BufferPolicy
+	items    []outbound
+	seq      uint64
+	flushing bool
+	closed   bool
+	// released is closed and replaced when a message leaves the buffer or the buffer is closed
+	released chan struct{}
+
+	publish   func(exchange, key string, pub *amqp.Publishing) error
+	connected func() bool
+	metrics   *Metrics
+	// onDrop is called for every message dropped from the buffer
+	onDrop func(exchange, key string, pub amqp.Publishing, err error)
+}
+
+func newBuffer(size int, policy BufferPolicy, publish func(exchange, key string, pub *amqp.Publishing) error, connected func() bool, m *Metrics) *buffer {
+	return &buffer{
+		size:      size,
+		policy:    policy,
+		released:  make(chan struct{}),
+		publish:   publish,
+		connected: connected,
+		metrics:   m,
+	}
+}
+
+// send buffers the message if the client is disconnected or older messages are not flushed yet.
+// Returns false if the message should be published directly.
+func (b *buffer) send(ctx context.Context, exchange, key string, pub *amqp.Publishing, force bool) (bool, error) {
+	var dropped []outbound
+	// dropped messages are reported after unlocking, so the hook may publish
+	defer func() { b.dropped(dropped, ErrBufferFull) }()
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if !force && len(b.items) == 0 && !b.flushing && b.connected() {
+		return false, nil
+	}
+
+	for len(b.items) >= b.size {
+		if b.closed {
+			return true, ErrClientClosed
+		}
+
+		switch b.policy {
+		case BufferFail:
+			return true, ErrBufferFull
+		case BufferDropOldest:
+			log.Warnf("AMQP: outbound buffer is full, message to exchange %s key %s dropped", b.items[0].exchange, b.items[0].key)
+			dropped = append(dropped, b.items[0])
+			b.items = b.items[1:]
+		default:
+			released := b.released
+			b.lock.Unlock()
+			select {
+			case <-released:
+			case <-ctx.Done():
+				b.lock.Lock()
+				return true, ctx.Err()
+			}
+			b.lock.Lock()
+		}
+	}
+	if b.closed {
+		return true, ErrClientClosed
+	}
+
+	b.seq++
+	b.items = append(b.items, outbound{seq: b.seq, exchange: exchange, key: key, pub: *pub})
+	b.metrics.bufferDepth(len(b.items))
+
+	// the connection may be restored while waiting
+	if !b.flushing && b.connected() {
+		go b.flush()
+	}
+
+	return true, nil
+}
+
+// flush publishes buffered messages in order until the buffer is empty or the connection is lost again.
+// A message failing while connected is published again bufferPublishAttempts times and then dropped.
+func (b *buffer) flush() {
+	b.lock.Lock()
+	if b.flushing || b.closed {
+		b.lock.Unlock()
+		return
+	}
+	b.flushing = true
+	b.lock.Unlock()
+
+	for {
+		b.lock.Lock()
+		if len(b.items) == 0 || b.closed {
+			b.flushing = false
+			b.lock.Unlock()
+			return
+		}
+		o := b.items[0]
+		b.lock.Unlock()
+
+		err := b.publish(o.exchange, o.key, &o.pub)
+		for attempt := 1; err != nil && b.connected() && attempt < bufferPublishAttempts && !b.isClosed(); attempt++ {
+			time.Sleep(time.Duration(attempt) * bufferDrainInterval)
+			err = b.publish(o.exchange, o.key, &o.pub)
+		}
+		if err != nil && !b.connected() {
+			// flushed again after reconnect
+			log.Warnf("AMQP: outbound buffer flush interrupted, err %v", err)
+			b.lock.Lock()
+			b.flushing = false
+			b.lock.Unlock()
+			return
+		}
+
+		b.lock.Lock()
+		// the head may be dropped by BufferDropOldest or close meanwhile
+		head := len(b.items) > 0 && b.items[0].seq == o.seq
+		if head {
+			b.items = b.items[1:]
+		}
+		b.metrics.bufferDepth(len(b.items))
+		b.release()
+		b.lock.Unlock()
+
+		if err != nil && head {
+			log.Errorf("AMQP: outbound buffer message to exchange %s key %s dropped, err %v", o.exchange, o.key, err)
+			b.dropped([]outbound{o}, err)
+		}
+	}
+}
+
+// dropped reports dropped messages, b.lock must not be held
+func (b *buffer) dropped(items []outbound, err error) {
+	for _, o := range items {
+		b.metrics.bufferDrop()
+		if b.onDrop != nil {
+			b.onDrop(o.exchange, o.key, o.pub, err)
+		}
+	}
+}
+
+func (b *buffer) isClosed() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.closed
+}
+
+// release wakes up blocked publishers, b.lock must be held
+func (b *buffer) release() {
+	close(b.released)
+	b.released = make(chan struct{})
+}
+
+func (b *buffer) depth() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return len(b.items)
+}
+
+// drain waits until buffered messages are flushed
+func (b *buffer) drain(ctx context.Context) error {
+	ticker := time.NewTicker(bufferDrainInterval)
+	defer ticker.Stop()
+
+	for b.depth() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
+
+// close drops buffered messages and releases blocked publishers
+func (b *buffer) close() {
+	b.lock.Lock()
+	dropped := b.items
+	if n := len(dropped); n > 0 {
+		log.Warnf("AMQP: client closed, %d buffered messages dropped", n)
+	}
+	b.closed = true
+	b.items = nil
+	b.metrics.bufferDepth(0)
+	b.release()
+	b.lock.Unlock()
+
+	b.dropped(dropped, ErrClientClosed)
+}
@@ -0,0 +1,214 @@
+package amqp_kit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type bufferPublisher struct {
+	lock      sync.Mutex
+	connected int32
+	err       error
+	failures  int
+	keys      []string
+}
+
+func (p *bufferPublisher) publish(exchange, key string, pub *amqp.Publishing) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.err != nil {
+		return p.err
+	}
+	if p.failures > 0 {
+		p.failures--
+		return errors.New("publish failed")
+	}
+	p.keys = append(p.keys, key)
+	return nil
+}
+
+func (p *bufferPublisher) isConnected() bool {
+	return atomic.LoadInt32(&p.connected) == 1
+}
+
+func (p *bufferPublisher) published() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return append([]string(nil), p.keys...)
+}
+
+func TestBufferFlushInOrder(t *testing.T) {
+	p := &bufferPublisher{}
+	b := newBuffer(3, BufferFail, p.publish, p.isConnected, nil)
+
+	for _, key := range []string{`a`, `b`, `c`} {
+		buffered, err := b.send(context.Background(), `exc`, key, &amqp.Publishing{}, false)
+		assert.True(t, buffered)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 3, b.depth())
+
+	_, err := b.send(context.Background(), `exc`, `d`, &amqp.Publishing{}, false)
+	assert.Equal(t, ErrBufferFull, err)
+
+	atomic.StoreInt32(&p.connected, 1)
+	b.flush()
+	assert.Equal(t, []string{`a`, `b`, `c`}, p.published())
+	assert.Equal(t, 0, b.depth())
+
+	buffered, err := b.send(context.Background(), `exc`, `e`, &amqp.Publishing{}, false)
+	assert.False(t, buffered)
+	assert.NoError(t, err)
+}
+
+func TestBufferFlushInterrupted(t *testing.T) {
+	p := &bufferPublisher{err: errors.New("connection closed")}
+	b := newBuffer(2, BufferFail, p.publish, p.isConnected, nil)
+
+	_, err := b.send(context.Background(), `exc`, `a`, &amqp.Publishing{}, true)
+	require.NoError(t, err)
+
+	// connection is lost again while flushing, the message is kept
+	b.flush()
+	assert.Equal(t, 1, b.depth())
+}
+
+func TestBufferFlushFailed(t *testing.T) {
+	p := &bufferPublisher{connected: 1, failures: bufferPublishAttempts - 1}
+	b := newBuffer(3, BufferFail, p.publish, p.isConnected, nil)
+	var dropped []string
+	b.onDrop = func(exchange, key string, pub amqp.Publishing, err error) {
+		dropped = append(dropped, key)
+		assert.EqualError(t, err, "publish failed")
+	}
+
+	for _, key := range []string{`a`, `b`} {
+		_, err := b.send(context.Background(), `exc`, key, &amqp.Publishing{}, true)
+		require.NoError(t, err)
+	}
+
+	// the head is published again while connected
+	b.flush()
+	assert.Equal(t, []string{`a`, `b`}, p.published())
+	assert.Empty(t, dropped)
+
+	// and dropped after all attempts
+	p.failures = bufferPublishAttempts
+	for _, key := range []string{`c`, `d`} {
+		_, err := b.send(context.Background(), `exc`, key, &amqp.Publishing{}, true)
+		require.NoError(t, err)
+	}
+	b.flush()
+	assert.Equal(t, []string{`a`, `b`, `d`}, p.published())
+	assert.Equal(t, []string{`c`}, dropped)
+	assert.Equal(t, 0, b.depth())
+}
+
+func TestBufferDropOldest(t *testing.T) {
+	p := &bufferPublisher{}
+	b := newBuffer(2, BufferDropOldest, p.publish, p.isConnected, nil)
+	var dropped []string
+	b.onDrop = func(exchange, key string, pub amqp.Publishing, err error) {
+		dropped = append(dropped, key)
+		assert.Equal(t, ErrBufferFull, err)
+	}
+
+	for _, key := range []string{`a`, `b`, `c`} {
+		_, err := b.send(context.Background(), `exc`, key, &amqp.Publishing{}, false)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 2, b.depth())
+	assert.Equal(t, []string{`a`}, dropped)
+
+	atomic.StoreInt32(&p.connected, 1)
+	b.flush()
+	assert.Equal(t, []string{`b`, `c`}, p.published())
+}
+
+func TestBufferBlock(t *testing.T) {
+	p := &bufferPublisher{}
+	b := newBuffer(1, BufferBlock, p.publish, p.isConnected, nil)
+
+	_, err := b.send(context.Background(), `exc`, `a`, &amqp.Publishing{}, false)
+	require.NoError(t, err)
+
+	sent := make(chan error, 1)
+	go func() {
+		_, err := b.send(context.Background(), `exc`, `b`, &amqp.Publishing{}, false)
+		sent <- err
+	}()
+
+	select {
+	case <-sent:
+		t.Fatal("send is not blocked by the full buffer")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	atomic.StoreInt32(&p.connected, 1)
+	go b.flush()
+
+	select {
+	case err := <-sent:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout. waiting for blocked send")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, b.drain(ctx))
+	assert.Equal(t, []string{`a`, `b`}, p.published())
+}
+
+func TestBufferClose(t *testing.T) {
+	p := &bufferPublisher{}
+	b := newBuffer(1, BufferBlock, p.publish, p.isConnected, nil)
+	dropped := make(chan error, 1)
+	b.onDrop = func(exchange, key string, pub amqp.Publishing, err error) { dropped <- err }
+
+	_, err := b.send(context.Background(), `exc`, `a`, &amqp.Publishing{}, false)
+	require.NoError(t, err)
+
+	sent := make(chan error, 1)
+	go func() {
+		_, err := b.send(context.Background(), `exc`, `b`, &amqp.Publishing{}, false)
+		sent <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	b.close()
+
+	select {
+	case err := <-sent:
+		assert.Equal(t, ErrClientClosed, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout. waiting for blocked send")
+	}
+	assert.Equal(t, 0, b.depth())
+	assert.Equal(t, ErrClientClosed, <-dropped)
+}
+
+func TestBufferBlockContext(t *testing.T) {
+	p := &bufferPublisher{}
+	b := newBuffer(1, BufferBlock, p.publish, p.isConnected, nil)
+
+	_, err := b.send(context.Background(), `exc`, `a`, &amqp.Publishing{}, false)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	buffered, err := b.send(ctx, `exc`, `b`, &amqp.Publishing{}, false)
+	assert.True(t, buffered)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 1, b.depth())
+}
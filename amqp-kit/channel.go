@@ -1,18 +1,80 @@
 package amqp_kit
 
 import (
+	"context"
+	"sync"
+
 	log "github.com/sirupsen/logrus"
 	"github.com/streadway/amqp"
 )
 
+// PoolStats describes the channel pool of the current connection
+type PoolStats struct {
+	// Max is the limit of open channels
+	Max int
+	// Open is the number of idle and acquired channels
+	Open int
+	// Idle is the number of channels waiting in the pool
+	Idle int
+	// Waiting is the number of callers waiting for a channel
+	Waiting int
+	// Evicted is the number of channels closed by the broker
+	Evicted uint64
+}
+
+// pool keeps up to size idle channels and opens up to max channels.
+// Callers wait for a channel when max channels are acquired.
 type pool struct {
-	ch chan *channel
-	c  *amqp.Connection
+	lock    sync.Mutex
+	c       AMQPConnection
+	idle    []*channel
+	open    int
+	size    int
+	max     int
+	retries int
+	waiting int
+	evicted uint64
+	closed  bool
+	// released is closed and replaced when a channel gets back to the pool or is closed
+	released chan struct{}
+	metrics  *Metrics
 }
 
 type channel struct {
-	c   *amqp.Channel
-	err error
+	c        AMQPChannel
+	pool     *pool
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+	err      error
+	// dropped is set by the pool when the channel is not counted as open anymore
+	dropped bool
+}
+
+// confirm puts the channel into confirm mode
+func (c *channel) confirm() error {
+	if err := c.c.Confirm(false); err != nil {
+		return err
+	}
+	// only one publishing waits for a confirm at a time
+	c.confirms = c.c.NotifyPublish(make(chan amqp.Confirmation, 1))
+
+	return nil
+}
+
+// mandatory registers a listener for returned publishings. In confirm mode returns
+// are taken by waitConfirm, otherwise they are passed to the handler.
+func (c *channel) mandatory(handler func(r amqp.Return)) {
+	// only one publishing waits for a return at a time
+	c.returns = c.c.NotifyReturn(make(chan amqp.Return, 1))
+	if c.confirms != nil {
+		return
+	}
+
+	go func(returns chan amqp.Return) {
+		for r := range returns {
+			handler(r)
+		}
+	}(c.returns)
 }
 
 func (c *channel) close() {
@@ -21,44 +83,177 @@ func (c *channel) close() {
 	}
 }
 
-func newPool(c *amqp.Connection, size int) *pool {
+func newPool(c AMQPConnection, size, max, retries int, m *Metrics) *pool {
+	if max < size {
+		max = size
+	}
+
 	return &pool{
-		c:  c,
-		ch: make(chan *channel, size),
+		c:        c,
+		size:     size,
+		max:      max,
+		retries:  retries,
+		released: make(chan struct{}),
+		metrics:  m,
 	}
 }
 
-func (p *pool) get() (*channel, error) {
-	select {
-	case conn := <-p.ch:
-		return conn, nil
-	default:
-		c := &channel{}
-		c.c, c.err = p.c.Channel()
-		return c, c.err
+// get returns an idle channel, opens a new one or waits until a channel is released or ctx is done
+func (p *pool) get(ctx context.Context) (*channel, error) {
+	for {
+		p.lock.Lock()
+		if p.closed {
+			p.lock.Unlock()
+			return nil, amqp.ErrClosed
+		}
+
+		if n := len(p.idle); n > 0 {
+			c := p.idle[n-1]
+			p.idle = p.idle[:n-1]
+			p.metrics.poolSize(len(p.idle))
+			p.lock.Unlock()
+			return c, nil
+		}
+
+		if p.open < p.max {
+			p.open++
+			p.lock.Unlock()
+			return p.openChannel()
+		}
+
+		released := p.released
+		p.waiting++
+		p.lock.Unlock()
+
+		select {
+		case <-released:
+			p.lock.Lock()
+			p.waiting--
+			p.lock.Unlock()
+		case <-ctx.Done():
+			p.lock.Lock()
+			p.waiting--
+			p.lock.Unlock()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// openChannel opens a channel counted as open, it makes up to retries attempts
+func (p *pool) openChannel() (*channel, error) {
+	p.metrics.poolMiss()
+
+	var (
+		ch  AMQPChannel
+		err error
+	)
+	for i := 0; i < p.retries; i++ {
+		if ch, err = p.c.Channel(); err == nil {
+			break
+		}
+		log.Warnf("AMQP: got a channel with err %s", err.Error())
+	}
+	if err != nil {
+		p.lock.Lock()
+		p.open--
+		p.release()
+		p.lock.Unlock()
+		return nil, err
 	}
+
+	c := &channel{c: ch, pool: p}
+	closes := ch.NotifyClose(make(chan *amqp.Error, 1))
+	go func() {
+		var err *amqp.Error
+		for e := range closes {
+			err = e
+		}
+		p.evict(c, err)
+	}()
+
+	return c, nil
 }
 
+// put returns the channel to the pool, a failed channel or a channel over the pool size is closed
 func (p *pool) put(c *channel) {
-	if c.err != nil {
+	p.lock.Lock()
+	if c.err == nil && !c.dropped && !p.closed && len(p.idle) < p.size {
+		p.idle = append(p.idle, c)
+		p.metrics.poolSize(len(p.idle))
+		p.release()
+		p.lock.Unlock()
 		return
 	}
+	// a channel dropped before is closed already
+	closed := c.dropped
+	p.drop(c)
+	p.lock.Unlock()
 
-	select {
-	case p.ch <- c:
+	switch {
+	case closed:
+	case c.err != nil:
+		// the failed channel is usually closed by the broker
+		_ = c.c.Close()
 	default:
 		c.close()
 	}
 }
 
-func (p *pool) clear() {
-	var c *channel
-	for {
-		select {
-		case c = <-p.ch:
-			c.close()
-		default:
-			return
+// evict drops the channel closed by the broker or by put
+func (p *pool) evict(c *channel, err *amqp.Error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for i, idle := range p.idle {
+		if idle == c {
+			p.idle = append(p.idle[:i], p.idle[i+1:]...)
+			p.metrics.poolSize(len(p.idle))
+			break
 		}
 	}
+	if err != nil {
+		p.evicted++
+		log.Warnf("AMQP: channel closed by broker, err %s", err)
+	}
+	p.drop(c)
+}
+
+// drop stops counting the channel as open, p.lock must be held
+func (p *pool) drop(c *channel) {
+	if c.dropped {
+		return
+	}
+	c.dropped = true
+	p.open--
+	p.release()
+}
+
+// release wakes up waiting callers, p.lock must be held
+func (p *pool) release() {
+	close(p.released)
+	p.released = make(chan struct{})
+}
+
+func (p *pool) stats() PoolStats {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return PoolStats{Max: p.max, Open: p.open, Idle: len(p.idle), Waiting: p.waiting, Evicted: p.evicted}
+}
+
+// clear closes idle channels, acquired channels are closed when they are put back
+func (p *pool) clear() {
+	p.lock.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	for _, c := range idle {
+		p.drop(c)
+	}
+	p.metrics.poolSize(0)
+	p.lock.Unlock()
+
+	for _, c := range idle {
+		c.close()
+	}
 }
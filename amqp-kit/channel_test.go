@@ -0,0 +1,205 @@
+package amqp_kit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeAMQPChannel is a channel of fakeConnection, only Close and NotifyClose are functional
+type fakeAMQPChannel struct {
+	fakeChannel
+	lock       sync.Mutex
+	closed     bool
+	closes     []chan *amqp.Error
+	declareErr error
+	consumeErr error
+}
+
+func (c *fakeAMQPChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	return nil
+}
+
+func (c *fakeAMQPChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	return amqp.Queue{Name: name}, c.declareErr
+}
+
+func (c *fakeAMQPChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWail bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	return make(chan amqp.Delivery), c.consumeErr
+}
+
+func (c *fakeAMQPChannel) QueueInspect(name string) (amqp.Queue, error) {
+	return amqp.Queue{Name: name}, nil
+}
+
+func (c *fakeAMQPChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	return nil
+}
+
+func (c *fakeAMQPChannel) Qos(prefetchCount, prefetchSize int, global bool) error { return nil }
+
+func (c *fakeAMQPChannel) Cancel(consumer string, noWait bool) error { return nil }
+
+func (c *fakeAMQPChannel) Confirm(noWait bool) error { return nil }
+
+func (c *fakeAMQPChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	return confirm
+}
+
+func (c *fakeAMQPChannel) NotifyReturn(r chan amqp.Return) chan amqp.Return { return r }
+
+func (c *fakeAMQPChannel) NotifyClose(ch chan *amqp.Error) chan *amqp.Error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.closes = append(c.closes, ch)
+	return ch
+}
+
+func (c *fakeAMQPChannel) Close() error {
+	return c.shutdown(nil)
+}
+
+// shutdown closes the channel as the broker does with a non-nil err
+func (c *fakeAMQPChannel) shutdown(err *amqp.Error) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return amqp.ErrClosed
+	}
+	c.closed = true
+	for _, ch := range c.closes {
+		if err != nil {
+			ch <- err
+		}
+		close(ch)
+	}
+	return nil
+}
+
+func (c *fakeAMQPChannel) isClosed() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.closed
+}
+
+type fakeConnection struct {
+	fails    int
+	attempts int
+	// channel is returned by Channel if set
+	channel *fakeAMQPChannel
+}
+
+func (c *fakeConnection) Channel() (AMQPChannel, error) {
+	c.attempts++
+	if c.attempts <= c.fails {
+		return nil, errors.New("channel error")
+	}
+	if c.channel != nil {
+		return c.channel, nil
+	}
+	return &fakeAMQPChannel{}, nil
+}
+
+func (c *fakeConnection) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error { return receiver }
+
+func (c *fakeConnection) NotifyBlocked(receiver chan amqp.Blocking) chan amqp.Blocking {
+	return receiver
+}
+
+func (c *fakeConnection) Close() error { return nil }
+
+func waitPool(p *pool, f func(s PoolStats) bool) PoolStats {
+	deadline := time.Now().Add(time.Second)
+	for !f(p.stats()) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	return p.stats()
+}
+
+func TestPoolMax(t *testing.T) {
+	p := newPool(&fakeConnection{}, 1, 2, 1, nil)
+
+	c1, err := p.get(context.Background())
+	require.NoError(t, err)
+	c2, err := p.get(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, PoolStats{Max: 2, Open: 2}, p.stats())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = p.get(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	got := make(chan *channel, 1)
+	go func() {
+		c, err := p.get(context.Background())
+		assert.NoError(t, err)
+		got <- c
+	}()
+	waitPool(p, func(s PoolStats) bool { return s.Waiting == 1 })
+
+	p.put(c1)
+	select {
+	case c := <-got:
+		assert.True(t, c == c1)
+	case <-time.After(time.Second):
+		t.Fatal("timeout. waiting for a released channel")
+	}
+
+	// the channel over the pool size is closed
+	p.put(c1)
+	p.put(c2)
+	assert.Equal(t, PoolStats{Max: 2, Open: 1, Idle: 1}, p.stats())
+	assert.True(t, c2.c.(*fakeAMQPChannel).isClosed())
+
+	p.clear()
+	assert.True(t, c1.c.(*fakeAMQPChannel).isClosed())
+	_, err = p.get(context.Background())
+	assert.Equal(t, amqp.ErrClosed, err)
+}
+
+func TestPoolEvict(t *testing.T) {
+	p := newPool(&fakeConnection{}, 2, 2, 1, nil)
+
+	idle, err := p.get(context.Background())
+	require.NoError(t, err)
+	acquired, err := p.get(context.Background())
+	require.NoError(t, err)
+	p.put(idle)
+
+	require.NoError(t, idle.c.(*fakeAMQPChannel).shutdown(amqp.ErrClosed))
+	require.NoError(t, acquired.c.(*fakeAMQPChannel).shutdown(amqp.ErrClosed))
+	stats := waitPool(p, func(s PoolStats) bool { return s.Evicted == 2 })
+	assert.Equal(t, PoolStats{Max: 2, Evicted: 2}, stats)
+
+	// the evicted channel is not returned to the pool
+	acquired.err = amqp.ErrClosed
+	p.put(acquired)
+	assert.Equal(t, PoolStats{Max: 2, Evicted: 2}, p.stats())
+}
+
+func TestPoolRetries(t *testing.T) {
+	conn := &fakeConnection{fails: 2}
+	p := newPool(conn, 1, 1, 3, nil)
+
+	_, err := p.get(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 3, conn.attempts)
+
+	conn = &fakeConnection{fails: 5}
+	p = newPool(conn, 1, 1, 3, nil)
+
+	_, err = p.get(context.Background())
+	assert.Error(t, err)
+	assert.Equal(t, 3, conn.attempts)
+	assert.Equal(t, 0, p.stats().Open)
+}
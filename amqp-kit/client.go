@@ -6,6 +6,7 @@ import (
 	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-kit/kit/endpoint"
@@ -15,68 +16,185 @@ import (
 
 const defaultReconnectAfterDuration = 500 * time.Millisecond
 const defaultWaitWorkerDuration = 5 * time.Second
+const defaultConfirmTimeout = 5 * time.Second
+const defaultShutdownTimeout = 30 * time.Second
 const DefaultExchangeKind = "topic"
 
 // Publisher interface use for publish amqp - message
 type Publisher interface {
 	Publish(exchange, key, corID string, body []byte) error
 	PublishWithTracing(ctx context.Context, exchange, key, corID string, body []byte) error
+	PublishWithOptions(ctx context.Context, exchange, key string, body []byte, opts ...PublishOption) error
 }
 
 // Client struct contains amqp - connection/reconnection and methods for pub/sub amqp message
 type Client struct {
+	// connectedAt is first to be 64-bit aligned for atomic access
+	connectedAt    int64
 	conn           *connection
 	connLock       sync.RWMutex
-	subs           []SubscribeInfo
+	subsLock       sync.Mutex
+	subs           map[string]*subscription
 	config         *Config
 	stopClientChan chan struct{}
+	stopOnce       sync.Once
 	exchLock       sync.RWMutex
 	exchanges      map[string]struct{}
+	rpcLock        sync.Mutex
+	rpc            *rpcClient
+	consumerLock   sync.Mutex
+	consumers      map[*consumer]struct{}
+	drainLock      sync.RWMutex
+	draining       bool
+	inFlight       sync.WaitGroup
+	state          int32
+	hooks          hooks
+	nodeIdx        int
+	metrics        *Metrics
+	ctx            context.Context
+	cancel         context.CancelFunc
+	dialer         Dialer
+	buffer         *buffer
 }
 
-// SubscriberInfo struct use for describe consumer for amqp
+// consumer is a running consumer, which can be cancelled by tag
+type consumer struct {
+	ch    AMQPChannel
+	tag   string
+	queue string
+	sub   *subscription
+}
+
+// SubscriberInfo struct use for describe consumer for amqp.
+// The queue is bound by Key and every one of Keys, Key defaults to the queue name
+// with dots if both are empty. Nil ExchangeInfo means the Config.Exchanges entry
+// or the default topic exchange, nil QueueInfo means a durable queue without arguments.
+// Every one of Workers opens a channel and a consumer, deliveries of a consumer are handled
+// by Concurrency goroutines in Ordering. PartitionKey is the key of OrderPerKey, the routing key by default.
+// With OrderPerKey deliveries of a busy key wait in memory, Prefetch limits their number.
+// Prefetch defaults to Concurrency.
+// Routes bind their keys too and get matched deliveries, other ones go to E.
+// BindArgs are the binding arguments of Key and Keys or of an empty key if there are no own keys,
+// for a headers exchange they are x-match and header values, and deliveries are routed by headers, see MatchHeaders.
+// MaxBacklog is the number of ready messages above which Health reports the queue, zero means no limit.
 type SubscribeInfo struct {
-	Name     string
-	Queue    string
-	Key      string
-	Exchange string
-	Workers  int
-	E        endpoint.Endpoint
-	Dec      DecodeRequestFunc
-	Enc      EncodeResponseFunc
-	O        []SubscriberOption
+	Name         string
+	Queue        string
+	Key          string
+	Keys         []string
+	BindArgs     amqp.Table
+	Exchange     string
+	ExchangeInfo *ExchangeInfo
+	QueueInfo    *QueueInfo
+	Workers      int
+	Prefetch     int
+	Concurrency  int
+	Ordering     Ordering
+	PartitionKey func(d *amqp.Delivery) string
+	E            endpoint.Endpoint
+	Dec          DecodeRequestFunc
+	Enc          EncodeResponseFunc
+	O            []SubscriberOption
+	Routes       []Route
+	MaxBacklog   int
 }
 
 // Config struct initialize config for Client struct
 type Config struct {
-	Address                string
-	User                   string
-	Password               string
-	VirtualHost            string
-	ChannelPoolSize        int
+	Address string
+	// Addresses are cluster nodes, Address is used if empty
+	Addresses []string
+	// NodeSelection is the order of trying Addresses on connect
+	NodeSelection NodeSelection
+	User          string
+	Password      string
+	VirtualHost   string
+	// TLS enables amqps connection
+	TLS *TLSConfig
+	// ExternalAuth uses the EXTERNAL SASL mechanism instead of User and Password
+	ExternalAuth bool
+	// ChannelPoolSize is the number of idle publishing channels kept open
+	ChannelPoolSize int
+	// ChannelPoolMax limits publishing channels, Publish waits for a channel when all are acquired.
+	// It is ChannelPoolSize by default.
+	ChannelPoolMax int
+	// ChannelRetryCount is the number of attempts to open a channel
 	ChannelRetryCount      int
 	ReconnectAfterDuration time.Duration
-	WaitWorkerDuration     time.Duration
+	// ReconnectMaxDuration limits the exponential reconnect backoff
+	ReconnectMaxDuration time.Duration
+	// ReconnectMultiplier grows the reconnect backoff each attempt
+	ReconnectMultiplier float64
+	WaitWorkerDuration  time.Duration
+	// PublishConfirm puts publishing channels into confirm mode, so Publish
+	// returns only after the broker has acked or nacked the message
+	PublishConfirm bool
+	// PublishMandatory publishes messages as mandatory, so the broker returns messages which
+	// are not routed to any queue. With PublishConfirm Publish returns ErrUnroutable for them,
+	// otherwise they are passed to the OnReturn hook.
+	PublishMandatory bool
+	// ConfirmTimeout limits the wait for a publisher confirm
+	ConfirmTimeout time.Duration
+	// ReplyQueue is the queue for Call replies, RabbitMQ direct reply-to is used if empty
+	ReplyQueue string
+	// Exchanges describes exchanges declared on publishing and subscribing,
+	// others are declared as durable topic exchanges
+	Exchanges map[string]ExchangeInfo
+	// ShutdownTimeout limits waiting for in-flight deliveries in Server.Stop
+	ShutdownTimeout time.Duration
+	// OutboundBuffer is the number of messages kept in memory by Publish while reconnecting,
+	// they are published in order once the connection is restored. Zero disables the buffer.
+	// Publish returns nil once the message is buffered, so delivery is not guaranteed:
+	// messages failing to publish after reconnect, dropped by BufferDropOldest or by Close
+	// are passed to the OnBufferDrop hook.
+	OutboundBuffer int
+	// OutboundBufferPolicy is the behavior of Publish when the outbound buffer is full
+	OutboundBufferPolicy BufferPolicy
 }
 
 // New AMQP Client with connection
-func New(cfg *Config) (*Client, error) {
+func New(cfg *Config, opts ...ClientOption) (*Client, error) {
 	ser := &Client{
 		config:         cfg,
 		stopClientChan: make(chan struct{}),
 		exchanges:      make(map[string]struct{}),
+		consumers:      make(map[*consumer]struct{}),
+	}
+	ser.ctx, ser.cancel = context.WithCancel(context.Background())
+	for _, opt := range opts {
+		opt(ser)
+	}
+	if cfg.OutboundBuffer > 0 {
+		publish := func(exchange, key string, pub *amqp.Publishing) error {
+			return ser.publish(ser.ctx, exchange, key, pub)
+		}
+		ser.buffer = newBuffer(cfg.OutboundBuffer, cfg.OutboundBufferPolicy, publish, func() bool {
+			return ser.State() == StateConnected
+		}, ser.metrics)
+		ser.buffer.onDrop = ser.hooks.onBufferDrop
 	}
 
 	if err := ser.reconnect(); err != nil {
+		ser.cancel()
 		return nil, err
 	}
 
 	return ser, nil
 }
 
-// MakeDsn - creates dsn from config
+// MakeDsn - creates dsn from config for the first node
 func MakeDsn(c *Config) string {
-	u := url.URL{Scheme: "amqp", User: url.UserPassword(c.User, c.Password), Host: c.Address, Path: "/" + c.VirtualHost}
+	return makeNodeDsn(c, c.nodes()[0])
+}
+
+func makeNodeDsn(c *Config, addr string) string {
+	u := url.URL{Scheme: "amqp", User: url.UserPassword(c.User, c.Password), Host: addr, Path: "/" + c.VirtualHost}
+	if c.TLS != nil {
+		u.Scheme = "amqps"
+	}
+	if c.ExternalAuth {
+		u.User = nil
+	}
 	return u.String()
 }
 
@@ -84,16 +202,96 @@ func (si *SubscribeInfo) keyName() string {
 	return strings.Replace(si.Queue, "_", ".", -1)
 }
 
+// consumerTag returns Name or a unique tag, so the consumer can be cancelled
+func (si *SubscribeInfo) consumerTag() string {
+	if si.Name != "" {
+		return si.Name
+	}
+
+	id, err := newCorrelationID()
+	if err != nil {
+		return ""
+	}
+	return si.Queue + "-" + id
+}
+
+// ownKeys returns Key and Keys
+func (si *SubscribeInfo) ownKeys() []string {
+	if si.Key == "" {
+		return si.Keys
+	}
+	return append([]string{si.Key}, si.Keys...)
+}
+
+// bindings returns bindings of own keys with BindArgs and bindings of routes,
+// BindArgs without own keys are bound with an empty key
+func (si *SubscribeInfo) bindings() []Binding {
+	var bindings []Binding
+	for _, key := range si.ownKeys() {
+		bindings = append(bindings, Binding{Key: key, Args: si.BindArgs})
+	}
+	if len(bindings) == 0 && si.BindArgs != nil {
+		bindings = append(bindings, Binding{Args: si.BindArgs})
+	}
+	for _, r := range si.Routes {
+		bindings = append(bindings, Binding{Key: r.Key, Args: r.BindArgs})
+	}
+	return bindings
+}
+
+// bindingKeys returns own keys and keys of routes
+func (si *SubscribeInfo) bindingKeys() []string {
+	keys := si.ownKeys()
+	for _, r := range si.Routes {
+		keys = append(keys[:len(keys):len(keys)], r.Key)
+	}
+	return keys
+}
+
+// prefetch lets every goroutine of the consumer get a delivery
+func (si *SubscribeInfo) prefetch() int {
+	if si.Prefetch > 0 {
+		return si.Prefetch
+	}
+	if si.Concurrency > 1 && si.Ordering != OrderStrict {
+		return si.Concurrency
+	}
+	return 1
+}
+
 func (c *Client) reconnect() error {
 	c.connLock.Lock()
 	defer c.connLock.Unlock()
 
-	conn := newConnection(c.config, c)
-	err := conn.connect()
+	var (
+		conn *connection
+		err  error
+	)
+	for _, idx := range c.nodeOrder() {
+		addr := c.config.nodes()[idx]
+		conn = newConnection(c.config, c, c.metrics, c.dialer)
+		if err = conn.connect(addr); err == nil {
+			c.nodeIdx = idx
+			log.Infof("AMQP: connected to %s", addr)
+			break
+		}
+		log.Warnf("AMQP: connection to %s err %v", addr, err)
+	}
 	if err != nil {
 		return err
 	}
 	c.conn = conn
+	c.setState(StateConnected)
+	atomic.StoreInt64(&c.connectedAt, time.Now().UnixNano())
+
+	if c.hooks.onBlocked != nil {
+		blocked := conn.amqpConn.NotifyBlocked(make(chan amqp.Blocking, 1))
+		go func() {
+			for b := range blocked {
+				c.hooks.onBlocked(b)
+			}
+		}()
+	}
 
 	return nil
 }
@@ -106,167 +304,260 @@ func (c *Client) getConnection() *connection {
 }
 
 func (c *Client) onCloseWithErr(conn *connection, err error) {
-	log.Warnf("AMQP: connection closed, err %v", err)
+	// closed by Close or Shutdown
+	select {
+	case <-c.stopClientChan:
+		return
+	default:
+	}
 
-	afterDuration := c.config.ReconnectAfterDuration
-	if afterDuration == 0 {
-		afterDuration = defaultReconnectAfterDuration
+	log.Warnf("AMQP: connection closed, err %v", err)
+	c.setState(StateReconnecting)
+	if c.hooks.onDisconnect != nil {
+		c.hooks.onDisconnect(err)
 	}
 
-	for {
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
 		select {
 		case <-c.stopClientChan:
 			return
-		default:
-			time.Sleep(afterDuration)
-			err = c.reconnect()
-			if err != nil {
-				log.Warnf("AMQP: reconnection err %v", err)
-			} else {
-				return
-			}
+		case <-time.After(c.reconnectDelay(attempt)):
+		}
+
+		if err = c.reconnect(); err != nil {
+			log.Warnf("AMQP: reconnection err %v", err)
+			continue
+		}
+
+		c.metrics.reconnect()
+		downtime := time.Since(start)
+		log.Infof("AMQP: reconnected in %s, attempts %d", downtime, attempt)
+		if c.hooks.onReconnect != nil {
+			c.hooks.onReconnect(attempt, downtime)
+		}
+		if c.buffer != nil {
+			go c.buffer.flush()
 		}
+		return
 	}
 }
 
 // Serve start consumers and listen amqp - messages
 func (c *Client) Serve(si []SubscribeInfo) (err error) {
-	subscribers := make(map[string]*SubscribeInfo)
+	queues := make(map[string]struct{})
 	for _, si := range si {
-		if _, ok := subscribers[si.Queue]; ok {
+		if _, ok := queues[si.Queue]; ok {
 			return fmt.Errorf("amqp_kit: duplicate queue entry: '%s' ", si.Queue)
 		}
-		s := si
-
-		if s.Workers == 0 {
-			s.Workers = 1
-		}
+		queues[si.Queue] = struct{}{}
+	}
 
-		if s.Key == "" {
-			s.Key = s.keyName()
+	subs := make([]*subscription, 0, len(si))
+	defer func() {
+		// started subscriptions are cancelled, so Serve may be called again
+		if err != nil {
+			for _, s := range subs {
+				_ = s.Cancel(context.Background())
+			}
 		}
-
-		subscribers[si.Queue] = &s
-	}
-
-	workerDuration := c.config.WaitWorkerDuration
-	if workerDuration == 0 {
-		workerDuration = defaultWaitWorkerDuration
-	}
-
-	for q, sub := range subscribers {
-		for i := 0; i < sub.Workers; i++ {
-			go func(si *SubscribeInfo) {
-				for {
-					select {
-					case <-c.stopClientChan:
-						log.Errorf(`stop client chan receiver for q: %s, n: %s, sub_exchange: %s`, si.Queue,
-							si.Name, si.Exchange)
-						return
-					default:
-						if err := c.receive(si); err != nil {
-							log.Errorf(`Receive for q: %s, name: %s, err: %s`, si.Queue, si.Name, err)
-						}
-					}
-					time.Sleep(1 * time.Second)
-				}
-			}(sub)
+	}()
+	for _, si := range si {
+		var s *subscription
+		if s, err = c.subscribe(si); err != nil {
+			return err
 		}
+		subs = append(subs, s)
+	}
 
-		t := time.Now().Add(workerDuration)
-		for {
-			conn := c.getConnection()
-			ch, err := conn.getChan()
-			if err != nil {
-				return fmt.Errorf("AMQP: Channel err: %s", err.Error())
-			}
-
-			if time.Now().After(t) {
-				return fmt.Errorf(`worker wait timeout`)
-			}
-
-			// the channel will be closed if error
-			qu, err := ch.c.QueueInspect(q)
-			if err != nil {
-				continue
-			}
-			conn.putChan(ch)
-
-			if qu.Consumers == sub.Workers {
-				break
-			}
+	timeout := time.After(c.waitWorkerDuration())
+	for _, s := range subs {
+		if err = s.wait(timeout); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
-func (c *Client) receive(si *SubscribeInfo) error {
-	conn := c.getConnection()
-	ch, err := conn.getChan()
+// receive consumes the queue until the channel is closed, restored means the consumer was started before,
+// ready is called after the consumer is started
+func (c *Client) receive(s *subscription, restored bool, ready func()) error {
+	si := s.si
+	// consumers own their channels, so they do not exhaust the pool
+	ch, err := c.getConnection().openChan()
 	if err != nil {
 		return fmt.Errorf("AMQP: Channel err: %s", err.Error())
 	}
-	defer conn.putChan(ch)
+	defer func() { _ = ch.Close() }()
 
-	if err = DeclareAndBind(ch.c, si.Exchange, si.Queue, si.Key, 1); err != nil {
+	ei := c.exchangeInfo(si.Exchange, si.ExchangeInfo)
+	if err = declareTopology(ch, si.Exchange, ei, si.Queue, si.QueueInfo, si.bindings(), si.prefetch()); err != nil {
 		return fmt.Errorf("AMQP: Declare and bind err: %s", err.Error())
 	}
 
-	msgs, err := ch.c.Consume(si.Queue, si.Name, false, false, false, false, nil)
+	cons := &consumer{ch: ch, tag: si.consumerTag(), queue: si.Queue, sub: s}
+	msgs, err := ch.Consume(si.Queue, cons.tag, false, false, false, false, nil)
 	if err != nil {
 		return fmt.Errorf("Channel consume err: %s ", err.Error())
 	}
-	fun := NewSubscriber(si.E, si.Dec, si.Enc, si.O...).ServeDelivery(ch.c)
+	c.addConsumer(cons)
+	defer c.removeConsumer(cons)
+	// the subscription may be cancelled before the consumer is added
+	if s.stopped() {
+		_ = ch.Cancel(cons.tag, false)
+	}
+	s.consumerStarted(restored)
+	defer s.consumerStopped()
+	ready()
+
+	if restored && c.hooks.onConsumerRestored != nil {
+		c.hooks.onConsumerRestored(si.Queue)
+	}
+	opts := append(si.O[:len(si.O):len(si.O)], SubscriberContext(c.ctx))
+	if c.metrics != nil {
+		opts = append(opts[:len(opts):len(opts)], SubscriberMetrics(c.metrics, si.Queue))
+	}
+	routes := newRouter(si, ei.kind(), ch, opts)
+	retries := routes.retryPolicies()
+	for _, p := range retries {
+		if p.Queue == "" {
+			p.Queue = si.Queue
+		}
+		if err = DeclareRetryQueues(ch, p); err != nil {
+			return fmt.Errorf("AMQP: Declare retry queues err: %s", err.Error())
+		}
+	}
+
+	workers := newDispatcher(si.Concurrency, si.Ordering, si.PartitionKey, func(d *amqp.Delivery) {
+		defer c.inFlight.Done()
+		routes.handler(d)(d)
+	})
 
 	for d := range msgs {
-		if si.Key != d.RoutingKey {
-			log.Errorf(`error routing key, expected: %s, real: %s`, si.Key, d.RoutingKey)
+		d := d
+		if len(retries) > 0 {
+			restoreRouting(&d)
+		}
+		if routes.handler(&d) == nil {
+			log.Errorf(`error routing key, expected: %s, real: %s`, strings.Join(si.bindingKeys(), ","), d.RoutingKey)
 			_ = d.Ack(false)
 			continue
 		}
 
-		fun(&d)
+		// deliveries left after the consumer was cancelled go back to the queue
+		if s.stopped() || !c.startHandling() {
+			_ = d.Nack(false, true)
+			continue
+		}
+
+		workers.dispatch(&d)
 	}
+	workers.close()
 
-	return fmt.Errorf("Close channel error ")
+	if c.isDraining() || s.stopped() {
+		return nil
+	}
+	return fmt.Errorf("AMQP: consumer channel of %s closed", si.Queue)
 }
 
-// DeclareAndBind create exchange, queue and create bind by key
-func DeclareAndBind(ch *amqp.Channel, exchange, queue, key string, qos int) error {
-	err := ch.ExchangeDeclare(exchange, "topic", true, false, false, false, nil)
-	if err != nil {
-		return err
-	}
+func (c *Client) addConsumer(cons *consumer) {
+	c.consumerLock.Lock()
+	defer c.consumerLock.Unlock()
 
-	_, err = ch.QueueDeclare(queue, true, false, false, false, nil)
-	if err != nil {
-		return err
+	c.consumers[cons] = struct{}{}
+	c.metrics.consumers(cons.queue, 1)
+}
+
+func (c *Client) removeConsumer(cons *consumer) {
+	c.consumerLock.Lock()
+	defer c.consumerLock.Unlock()
+
+	delete(c.consumers, cons)
+	c.metrics.consumers(cons.queue, -1)
+}
+
+// cancelConsumers cancels consumers of the subscription or all if sub is nil
+func (c *Client) cancelConsumers(sub *subscription) {
+	c.consumerLock.Lock()
+	defer c.consumerLock.Unlock()
+
+	for cons := range c.consumers {
+		if sub != nil && cons.sub != sub {
+			continue
+		}
+		if err := cons.ch.Cancel(cons.tag, false); err != nil {
+			log.Warnf(`AMQP: cancel consumer %s err: %s`, cons.tag, err)
+		}
 	}
+}
 
-	if err := ch.Qos(qos, 0, false); err != nil {
-		return err
+// startHandling registers an in-flight delivery, it returns false if the client is draining
+func (c *Client) startHandling() bool {
+	c.drainLock.RLock()
+	defer c.drainLock.RUnlock()
+
+	if c.draining {
+		return false
 	}
+	c.inFlight.Add(1)
+
+	return true
+}
+
+func (c *Client) isDraining() bool {
+	c.drainLock.RLock()
+	defer c.drainLock.RUnlock()
 
-	return ch.QueueBind(queue, key, exchange, false, nil)
+	return c.draining
+}
+
+// DeclareAndBind create exchange, queue and create bind by key
+func DeclareAndBind(ch AMQPChannel, exchange, queue, key string, qos int) error {
+	return DeclareTopology(ch, exchange, nil, queue, nil, []string{key}, qos)
 }
 
 // Publish publishing some message to given exchange with key and correlationID
 func (c *Client) Publish(exchange, key, corID string, body []byte) error {
 	pub := amqp.Publishing{
-		ContentType:   "application/json",
+		ContentType:   ContentTypeJSON,
 		CorrelationId: corID,
 		Body:          body,
 		DeliveryMode:  amqp.Persistent,
 	}
 
-	return c.send(exchange, key, &pub)
+	return c.send(c.ctx, exchange, key, &pub)
 }
 
-func (c *Client) send(exchange, key string, pub *amqp.Publishing) error {
-	// add retry
+func (c *Client) send(ctx context.Context, exchange, key string, pub *amqp.Publishing) error {
+	if c.buffer == nil {
+		return c.publish(ctx, exchange, key, pub)
+	}
+
+	if buffered, err := c.buffer.send(ctx, exchange, key, pub, false); buffered {
+		return err
+	}
+	err := c.publish(ctx, exchange, key, pub)
+	if err != nil && c.State() == StateReconnecting {
+		_, err = c.buffer.send(ctx, exchange, key, pub, true)
+	}
+
+	return err
+}
+
+// BufferDepth returns the number of messages waiting in the outbound buffer
+func (c *Client) BufferDepth() int {
+	if c.buffer == nil {
+		return 0
+	}
+	return c.buffer.depth()
+}
+
+func (c *Client) publish(ctx context.Context, exchange, key string, pub *amqp.Publishing) (err error) {
+	defer func(begin time.Time) { c.metrics.publish(exchange, key, err, begin) }(time.Now())
+
 	conn := c.getConnection()
-	channel, err := conn.getChan()
+	channel, err := conn.getChan(ctx)
 	if err != nil {
 		return fmt.Errorf("AMQP: Channel err: %s", err.Error())
 	}
@@ -278,19 +569,81 @@ func (c *Client) send(exchange, key string, pub *amqp.Publishing) error {
 		return err
 	}
 
-	if err = channel.c.Publish(exchange, key, false, false, *pub); err != nil {
+	if c.config.PublishConfirm && channel.confirms == nil {
+		if err = channel.confirm(); err != nil {
+			channel.err = err
+			return fmt.Errorf("AMQP: Channel confirm err: %s", err.Error())
+		}
+	}
+
+	if c.config.PublishMandatory && channel.returns == nil {
+		channel.mandatory(c.handleReturn)
+	}
+
+	if err = channel.c.Publish(exchange, key, c.config.PublishMandatory, false, *pub); err != nil {
 		channel.err = err
 		return fmt.Errorf("AMQP: Exchange Publish err: %s", err.Error())
 	}
 
+	if channel.confirms != nil {
+		return c.waitConfirm(channel)
+	}
+
 	return nil
 }
 
-// GetAMQPConnection get simple amqp.Connection
+func (c *Client) handleReturn(r amqp.Return) {
+	if c.hooks.onReturn != nil {
+		c.hooks.onReturn(r)
+		return
+	}
+	log.Warnf("AMQP: message to exchange %s key %s returned: %d %s", r.Exchange, r.RoutingKey, r.ReplyCode, r.ReplyText)
+}
+
+func (c *Client) waitConfirm(channel *channel) error {
+	timeout := c.config.ConfirmTimeout
+	if timeout == 0 {
+		timeout = defaultConfirmTimeout
+	}
+
+	select {
+	case confirm, ok := <-channel.confirms:
+		if !ok {
+			channel.err = fmt.Errorf("AMQP: Channel closed while waiting for confirm")
+			return channel.err
+		}
+		if !confirm.Ack {
+			return ErrPublishNack
+		}
+		// the broker sends a return before the confirm of the message
+		select {
+		case r := <-channel.returns:
+			log.Warnf("AMQP: message to exchange %s key %s returned: %d %s", r.Exchange, r.RoutingKey, r.ReplyCode, r.ReplyText)
+			return ErrUnroutable
+		default:
+		}
+		return nil
+	case <-time.After(timeout):
+		// a late confirm would be taken as the answer for the next message
+		channel.err = ErrConfirmTimeout
+		channel.close()
+		return ErrConfirmTimeout
+	}
+}
+
+// GetAMQPConnection get simple amqp.Connection, nil if the client uses a custom Dialer
 func (c *Client) GetAMQPConnection() *amqp.Connection {
 	conn := c.getConnection()
 
-	return conn.amqpConn
+	if ac, ok := conn.amqpConn.(amqpConnection); ok {
+		return ac.Connection
+	}
+	return nil
+}
+
+// PoolStats returns statistics of the publishing channel pool of the current connection
+func (c *Client) PoolStats() PoolStats {
+	return c.getConnection().stats()
 }
 
 // Ping is health - check for amqp connection
@@ -314,7 +667,15 @@ func (c *Client) Close() error {
 	c.connLock.Lock()
 	defer c.connLock.Unlock()
 
-	close(c.stopClientChan)
+	c.stopOnce.Do(func() { close(c.stopClientChan) })
+	c.setState(StateClosed)
+	if c.buffer != nil {
+		c.buffer.close()
+	}
+	// cancel handlers still running
+	if c.cancel != nil {
+		c.cancel()
+	}
 	if c.conn != nil {
 		return c.conn.close()
 	}
@@ -322,12 +683,50 @@ func (c *Client) Close() error {
 	return nil
 }
 
+// Shutdown gracefully stops the client: it cancels consumers, stops taking new deliveries,
+// waits for in-flight deliveries and the outbound buffer flush until ctx is done and closes the connection.
+// The client keeps reconnecting until the buffer is flushed.
+func (c *Client) Shutdown(ctx context.Context) error {
+	c.drainLock.Lock()
+	c.draining = true
+	c.drainLock.Unlock()
+
+	c.cancelConsumers(nil)
+
+	done := make(chan struct{})
+	go func() {
+		c.inFlight.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if c.buffer != nil && err == nil {
+		err = c.buffer.drain(ctx)
+	}
+
+	if closeErr := c.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
 func (c *Client) checkExchange(channel *channel, exchange string) error {
+	// the default exchange always exists
+	if exchange == "" {
+		return nil
+	}
+
 	if ok := c.checkExchangeWithRLock(exchange); ok {
 		return nil
 	}
 
-	err := channel.c.ExchangeDeclare(exchange, DefaultExchangeKind, true, false, false, false, nil)
+	err := DeclareExchange(channel.c, exchange, c.exchangeInfo(exchange, nil))
 	if err != nil {
 		return err
 	}
@@ -339,6 +738,17 @@ func (c *Client) checkExchange(channel *channel, exchange string) error {
 	return nil
 }
 
+// exchangeInfo returns ei if set, otherwise the description from config
+func (c *Client) exchangeInfo(exchange string, ei *ExchangeInfo) *ExchangeInfo {
+	if ei != nil {
+		return ei
+	}
+	if info, ok := c.config.Exchanges[exchange]; ok {
+		return &info
+	}
+	return &ExchangeInfo{}
+}
+
 func (c *Client) checkExchangeWithRLock(exchange string) bool {
 	c.exchLock.RLock()
 	defer c.exchLock.RUnlock()
@@ -255,3 +255,52 @@ func (s *apiSuite) TestServeMany() {
 	err = cl.Close()
 	s.Require().NoError(err)
 }
+
+func (s *apiSuite) TestPublishConfirm() {
+	cl, err := New(&Config{
+		Address:        rabbitTestAddr,
+		User:           "guest",
+		Password:       "guest",
+		PublishConfirm: true,
+		ConfirmTimeout: time.Second,
+	})
+	s.Require().NoError(err)
+
+	err = cl.Publish("exc-confirm", "confirm.a", `cor_1`, []byte(`{"f1":"b1"}`))
+	s.Require().NoError(err)
+
+	err = cl.PublishWithTracing(context.Background(), "exc-confirm", "confirm.a", `cor_2`, []byte(`{"f2":"b2"}`))
+	s.Require().NoError(err)
+
+	err = cl.PublishWithOptions(context.Background(), "exc-confirm", "confirm.a", []byte(`{"f3":"b3"}`),
+		PublishCorrelationID(`cor_3`), PublishMessageID(`msg_3`), PublishPriority(1))
+	s.Require().NoError(err)
+
+	s.Require().NoError(cl.Close())
+}
+
+func (s *apiSuite) TestSubscribe() {
+	cl, err := New(s.config)
+	s.Require().NoError(err)
+	defer cl.Close()
+
+	sub, err := cl.Subscribe(SubscribeInfo{
+		Queue:    `runtime_q`,
+		Exchange: `exc`,
+		E: func(ctx context.Context, request interface{}) (response interface{}, err error) {
+			return nil, nil
+		},
+		Dec: func(i context.Context, delivery *amqp.Delivery) (request interface{}, err error) {
+			return nil, nil
+		},
+		Enc: EncodeJSONResponse,
+	})
+	s.Require().NoError(err)
+	s.Equal(SubscriptionActive, sub.Status().State)
+	s.Equal(1, sub.Status().Consumers)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	s.Require().NoError(sub.Cancel(ctx))
+	s.Equal(SubscriptionCancelled, sub.Status().State)
+}
@@ -0,0 +1,219 @@
+package amqp_kit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"reflect"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	// ContentTypeJSON is the default content type of messages
+	ContentTypeJSON = "application/json"
+	// ContentEncodingGzip is the gzip content encoding
+	ContentEncodingGzip = "gzip"
+)
+
+// Codec marshals and unmarshals message bodies of a content type
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// Compressor compresses and decompresses message bodies of a content encoding
+type Compressor interface {
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+var (
+	codecsLock  sync.RWMutex
+	codecs      = map[string]Codec{ContentTypeJSON: jsonCodec{}}
+	compressors = map[string]Compressor{ContentEncodingGzip: gzipCompressor{}}
+)
+
+// RegisterCodec adds a codec for the content type, e.g. protobuf or msgpack
+func RegisterCodec(contentType string, c Codec) {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+
+	codecs[contentType] = c
+}
+
+// RegisterCompressor adds a compressor for the content encoding
+func RegisterCompressor(contentEncoding string, c Compressor) {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+
+	compressors[contentEncoding] = c
+}
+
+// getCodec returns the codec of the media type, parameters like charset are ignored
+func getCodec(contentType string) (Codec, error) {
+	if contentType == "" {
+		contentType = ContentTypeJSON
+	}
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		contentType = mediaType
+	}
+
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+
+	c, ok := codecs[contentType]
+	if !ok {
+		return nil, fmt.Errorf("amqp_kit: unknown content type: '%s'", contentType)
+	}
+	return c, nil
+}
+
+func getCompressor(contentEncoding string) (Compressor, error) {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+
+	c, ok := compressors[contentEncoding]
+	if !ok {
+		return nil, fmt.Errorf("amqp_kit: unknown content encoding: '%s'", contentEncoding)
+	}
+	return c, nil
+}
+
+// Marshal encodes v with the codec of the content type and the compressor of the content encoding.
+// Empty content type means JSON, empty content encoding means no compression.
+func Marshal(contentType, contentEncoding string, v interface{}) ([]byte, error) {
+	codec, err := getCodec(contentType)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := codec.Marshal(v)
+	if err != nil || contentEncoding == "" {
+		return b, err
+	}
+
+	compressor, err := getCompressor(contentEncoding)
+	if err != nil {
+		return nil, err
+	}
+	return compressor.Compress(b)
+}
+
+// Unmarshal decodes data into v with the codec of the content type and the compressor of the content encoding
+func Unmarshal(contentType, contentEncoding string, data []byte, v interface{}) error {
+	codec, err := getCodec(contentType)
+	if err != nil {
+		return err
+	}
+
+	if contentEncoding != "" {
+		compressor, err := getCompressor(contentEncoding)
+		if err != nil {
+			return err
+		}
+		if data, err = compressor.Decompress(data); err != nil {
+			return err
+		}
+	}
+
+	return codec.Unmarshal(data, v)
+}
+
+// DecodeRequest returns a DecodeRequestFunc, which decodes the delivery body by its
+// ContentType and ContentEncoding into a new value of the prototype type.
+// The request is a pointer to the new value.
+func DecodeRequest(prototype interface{}) DecodeRequestFunc {
+	return decodeRequest(prototype, "")
+}
+
+// DecodeJSONRequest returns a DecodeRequestFunc, which decodes the JSON delivery body
+// into a new value of the prototype type. The request is a pointer to the new value.
+func DecodeJSONRequest(prototype interface{}) DecodeRequestFunc {
+	return decodeRequest(prototype, ContentTypeJSON)
+}
+
+// decodeRequest decodes by the given content type or by the delivery one if empty
+func decodeRequest(prototype interface{}, contentType string) DecodeRequestFunc {
+	t := prototypeType(prototype)
+
+	return func(_ context.Context, d *amqp.Delivery) (interface{}, error) {
+		ct := contentType
+		if ct == "" {
+			ct = d.ContentType
+		}
+
+		v := reflect.New(t).Interface()
+		if err := Unmarshal(ct, d.ContentEncoding, d.Body, v); err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+}
+
+func prototypeType(prototype interface{}) reflect.Type {
+	t := reflect.TypeOf(prototype)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+// EncodeResponse encodes the response in the content type and encoding of the request
+// and sends the response to the given channel as a reply. The JSON default of the reply
+// is replaced by the request format, other content types set by hooks are kept.
+// Use EncodeJSONResponse to reply JSON to requests of other content types.
+func EncodeResponse(ctx context.Context, deliv *amqp.Delivery, ch Channel, pub *amqp.Publishing, response interface{}) error {
+	if (pub.ContentType == "" || pub.ContentType == ContentTypeJSON) && deliv.ContentType != "" {
+		pub.ContentType, pub.ContentEncoding = deliv.ContentType, deliv.ContentEncoding
+	}
+	if pub.ContentType == "" {
+		pub.ContentType = ContentTypeJSON
+	}
+
+	b, err := Marshal(pub.ContentType, pub.ContentEncoding, response)
+	if err != nil {
+		return err
+	}
+
+	return publishReply(ctx, deliv, ch, pub, pub.ContentType, b)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
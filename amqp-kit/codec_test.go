@@ -0,0 +1,143 @@
+package amqp_kit
+
+import (
+	"context"
+	"encoding/xml"
+	"testing"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type codecRequest struct {
+	Foo string `json:"foo" xml:"foo"`
+}
+
+type xmlCodec struct{}
+
+func (xmlCodec) Marshal(v interface{}) ([]byte, error) {
+	return xml.Marshal(v)
+}
+
+func (xmlCodec) Unmarshal(data []byte, v interface{}) error {
+	return xml.Unmarshal(data, v)
+}
+
+func TestMarshalUnmarshal(t *testing.T) {
+	b, err := Marshal(``, ContentEncodingGzip, codecRequest{Foo: `bar`})
+	require.NoError(t, err)
+
+	var req codecRequest
+	require.NoError(t, Unmarshal(ContentTypeJSON, ContentEncodingGzip, b, &req))
+	assert.Equal(t, `bar`, req.Foo)
+
+	_, err = Marshal(`application/unknown`, ``, req)
+	assert.Error(t, err)
+
+	_, err = Marshal(ContentTypeJSON, `unknown`, req)
+	assert.Error(t, err)
+}
+
+func TestDecodeRequest(t *testing.T) {
+	RegisterCodec(`application/xml`, xmlCodec{})
+
+	req, err := DecodeRequest(codecRequest{})(context.Background(), &amqp.Delivery{
+		ContentType: `application/xml`,
+		Body:        []byte(`<codecRequest><foo>bar</foo></codecRequest>`),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, &codecRequest{Foo: `bar`}, req)
+
+	req, err = DecodeJSONRequest(&codecRequest{})(context.Background(), &amqp.Delivery{
+		ContentType: `text/plain`,
+		Body:        []byte(`{"foo":"bar"}`),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, &codecRequest{Foo: `bar`}, req)
+
+	// parameters of the content type are ignored
+	req, err = DecodeRequest(codecRequest{})(context.Background(), &amqp.Delivery{
+		ContentType: `application/json; charset=utf-8`,
+		Body:        []byte(`{"foo":"bar"}`),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, &codecRequest{Foo: `bar`}, req)
+
+	_, err = DecodeRequest(codecRequest{})(context.Background(), &amqp.Delivery{Body: []byte(`not json`)})
+	assert.Error(t, err)
+}
+
+func TestEncodeResponse(t *testing.T) {
+	ch := &fakeChannel{}
+	d := &amqp.Delivery{
+		ContentType:     ContentTypeJSON,
+		ContentEncoding: ContentEncodingGzip,
+		CorrelationId:   `cor_1`,
+		ReplyTo:         `reply`,
+	}
+
+	err := EncodeResponse(context.Background(), d, ch, &amqp.Publishing{}, codecRequest{Foo: `bar`})
+	require.NoError(t, err)
+	require.Len(t, ch.published, 1)
+
+	msg := ch.published[0]
+	assert.Equal(t, `reply`, msg.key)
+	assert.Equal(t, `cor_1`, msg.msg.CorrelationId)
+	assert.Equal(t, ContentEncodingGzip, msg.msg.ContentEncoding)
+
+	var resp codecRequest
+	require.NoError(t, Unmarshal(msg.msg.ContentType, msg.msg.ContentEncoding, msg.msg.Body, &resp))
+	assert.Equal(t, `bar`, resp.Foo)
+}
+
+func TestEncodeResponseContentTypeSet(t *testing.T) {
+	ch := &fakeChannel{}
+	d := &amqp.Delivery{ContentType: `application/x-unknown`, ReplyTo: `reply`}
+
+	// the content type set by a hook is kept
+	RegisterCodec(`application/xml`, xmlCodec{})
+	pub := &amqp.Publishing{ContentType: `application/xml`}
+	require.NoError(t, EncodeResponse(context.Background(), d, ch, pub, codecRequest{Foo: `bar`}))
+	require.Len(t, ch.published, 1)
+	assert.Equal(t, `application/xml`, ch.published[0].msg.ContentType)
+	assert.Equal(t, []byte(`<codecRequest><foo>bar</foo></codecRequest>`), ch.published[0].msg.Body)
+
+	require.NoError(t, EncodeJSONResponse(context.Background(), d, ch, &amqp.Publishing{}, codecRequest{Foo: `bar`}))
+	require.Len(t, ch.published, 2)
+	assert.Equal(t, ContentTypeJSON, ch.published[1].msg.ContentType)
+
+	// the reply keeps parameters of the request content type
+	d.ContentType = `application/json; charset=utf-8`
+	require.NoError(t, EncodeResponse(context.Background(), d, ch, &amqp.Publishing{}, codecRequest{Foo: `bar`}))
+	require.Len(t, ch.published, 3)
+	assert.Equal(t, `application/json; charset=utf-8`, ch.published[2].msg.ContentType)
+	assert.Equal(t, []byte(`{"foo":"bar"}`), ch.published[2].msg.Body)
+}
+
+func TestSubscriberEncodeResponse(t *testing.T) {
+	RegisterCodec(`application/xml`, xmlCodec{})
+	sub := NewSubscriber(
+		func(ctx context.Context, request interface{}) (interface{}, error) { return request, nil },
+		DecodeRequest(codecRequest{}),
+		EncodeResponse,
+	)
+
+	// the reply is in the request format instead of the JSON default
+	ch := &fakeChannel{}
+	sub.ServeDelivery(ch)(&amqp.Delivery{
+		Acknowledger: &fakeAcknowledger{},
+		ContentType:  `application/xml`,
+		ReplyTo:      `reply`,
+		Body:         []byte(`<codecRequest><foo>bar</foo></codecRequest>`),
+	})
+	require.Len(t, ch.published, 1)
+	assert.Equal(t, `application/xml`, ch.published[0].msg.ContentType)
+	assert.Equal(t, []byte(`<codecRequest><foo>bar</foo></codecRequest>`), ch.published[0].msg.Body)
+
+	// a request without content type gets the JSON reply
+	sub.ServeDelivery(ch)(&amqp.Delivery{Acknowledger: &fakeAcknowledger{}, ReplyTo: `reply`, Body: []byte(`{"foo":"bar"}`)})
+	require.Len(t, ch.published, 2)
+	assert.Equal(t, ContentTypeJSON, ch.published[1].msg.ContentType)
+	assert.Equal(t, []byte(`{"foo":"bar"}`), ch.published[1].msg.Body)
+}
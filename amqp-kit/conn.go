@@ -1,6 +1,7 @@
 package amqp_kit
 
 import (
+	"context"
 	"sync"
 
 	log "github.com/sirupsen/logrus"
@@ -16,35 +17,44 @@ type connectionCloseHandler interface {
 
 type connection struct {
 	config       *Config
-	amqpConn     *amqp.Connection
+	addr         string
+	amqpConn     AMQPConnection
 	pool         *pool
 	poolLock     sync.RWMutex
 	closeHandler connectionCloseHandler
+	metrics      *Metrics
+	dialer       Dialer
 }
 
-func newConnection(config *Config, closeHandler connectionCloseHandler) *connection {
+func newConnection(config *Config, closeHandler connectionCloseHandler, m *Metrics, d Dialer) *connection {
+	if d == nil {
+		d = dial
+	}
 	conn := &connection{
 		config:       config,
 		closeHandler: closeHandler,
+		metrics:      m,
+		dialer:       d,
 	}
 	return conn
 }
 
-func (c *connection) connect() error {
+func (c *connection) connect(addr string) error {
 	c.poolLock.Lock()
 	defer c.poolLock.Unlock()
 
-	amqpConn, err := amqp.Dial(MakeDsn(c.config))
+	amqpConn, err := c.dialer(c.config, addr)
 	if err != nil {
 		return err
 	}
+	c.addr = addr
 	c.amqpConn = amqpConn
 	poolSize := c.config.ChannelPoolSize
 	if poolSize == 0 {
 		poolSize = defaultChannelPoolSize
 	}
 
-	c.pool = newPool(c.amqpConn, poolSize)
+	c.pool = newPool(c.amqpConn, poolSize, c.config.ChannelPoolMax, c.retryCount(), c.metrics)
 	notifyChan := make(chan *amqp.Error)
 	amqpConn.NotifyClose(notifyChan)
 	go func() {
@@ -52,46 +62,60 @@ func (c *connection) connect() error {
 		log.Errorf(`err notify: %s`, e)
 		// clear pool
 		c.clearPool()
-		// init new connection
-		c.closeHandler.onCloseWithErr(c, e)
+		// init new connection, a nil *amqp.Error means graceful close
+		var err error
+		if e != nil {
+			err = e
+		}
+		c.closeHandler.onCloseWithErr(c, err)
 	}()
 
 	return nil
 }
 
-func (c *connection) getChan() (*channel, error) {
-	var (
-		channel *channel
-		err     error
-	)
+// getChan acquires a channel of the pool, it waits for a released channel until ctx is done
+func (c *connection) getChan(ctx context.Context) (*channel, error) {
+	c.poolLock.RLock()
+	p := c.pool
+	c.poolLock.RUnlock()
 
-	retryCount := c.config.ChannelRetryCount
-	if retryCount == 0 {
-		retryCount = defaultChannelRetryCount
-	}
+	return p.get(ctx)
+}
 
-	for i := 0; i < defaultChannelRetryCount; i++ {
-		c.poolLock.RLock()
-		channel, err = c.pool.get()
-		c.poolLock.RUnlock()
-		if err == nil {
+// putChan returns the channel to its pool, which may be already replaced after reconnect
+func (c *connection) putChan(channel *channel) {
+	channel.pool.put(channel)
+}
+
+// openChan opens a channel out of the pool, e.g. for a consumer
+func (c *connection) openChan() (AMQPChannel, error) {
+	var (
+		ch  AMQPChannel
+		err error
+	)
+	for i := 0; i < c.retryCount(); i++ {
+		if ch, err = c.amqpConn.Channel(); err == nil {
 			break
-		} else {
-			log.Warnf("AMQP: got a channel with err %s", err.Error())
 		}
+		log.Warnf("AMQP: got a channel with err %s", err.Error())
 	}
-	return channel, err
+
+	return ch, err
 }
 
-func (c *connection) putChan(channel *channel) {
+// stats returns statistics of the pool
+func (c *connection) stats() PoolStats {
 	c.poolLock.RLock()
-	p := c.pool
-	c.poolLock.RUnlock()
-	if p != nil {
-		p.put(channel)
-	} else {
-		channel.close()
+	defer c.poolLock.RUnlock()
+
+	return c.pool.stats()
+}
+
+func (c *connection) retryCount() int {
+	if c.config.ChannelRetryCount > 0 {
+		return c.config.ChannelRetryCount
 	}
+	return defaultChannelRetryCount
 }
 
 func (c *connection) clearPool() {
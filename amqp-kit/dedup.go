@@ -0,0 +1,200 @@
+package amqp_kit
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// DedupRecord is the outcome of a handled delivery, the reply is sent again for its duplicates
+type DedupRecord struct {
+	Replied         bool
+	Exchange        string
+	Key             string
+	ContentType     string
+	ContentEncoding string
+	Body            []byte
+}
+
+// DedupStore keeps outcomes of handled deliveries by idempotency key
+type DedupStore interface {
+	// Get returns nil record if the key is unknown or expired
+	Get(ctx context.Context, key string) (*DedupRecord, error)
+	Put(ctx context.Context, key string, r *DedupRecord) error
+}
+
+// DedupKeyFunc returns the idempotency key of the delivery, an empty key disables deduplication of the delivery
+type DedupKeyFunc func(d *amqp.Delivery) string
+
+// DedupByMessageID uses MessageId as the idempotency key
+func DedupByMessageID(d *amqp.Delivery) string {
+	return d.MessageId
+}
+
+// DedupByCorrelationID uses CorrelationId as the idempotency key
+func DedupByCorrelationID(d *amqp.Delivery) string {
+	return d.CorrelationId
+}
+
+// SubscriberDedup checks the store before calling the endpoint. A duplicate is acked
+// and gets the original reply instead of running the endpoint again.
+// The outcome is stored after a successful encoding only, so failed deliveries are handled again.
+// Nil key means DedupByMessageID. Queues sharing a store need keys with the queue name.
+func SubscriberDedup(store DedupStore, key DedupKeyFunc) SubscriberOption {
+	if key == nil {
+		key = DedupByMessageID
+	}
+
+	return func(s *Subscriber) {
+		s.dedup = &dedup{store: store, key: key}
+	}
+}
+
+type dedup struct {
+	store DedupStore
+	key   DedupKeyFunc
+}
+
+// replay sends the recorded reply to the duplicate and acks it, it returns false if the delivery is not a duplicate
+func (d *dedup) replay(ctx context.Context, key string, deliv *amqp.Delivery, ch Channel) bool {
+	r, err := d.store.Get(ctx, key)
+	if err != nil {
+		log.Warnf("AMQP: dedup store get key %s err: %s", key, err)
+		return false
+	}
+	if r == nil {
+		return false
+	}
+
+	if r.Replied {
+		replyTo := deliv.ReplyTo
+		if replyTo == "" {
+			replyTo = r.Key
+		}
+
+		err = ch.Publish(r.Exchange, replyTo, false, false, amqp.Publishing{
+			CorrelationId:   deliv.CorrelationId,
+			ContentType:     r.ContentType,
+			ContentEncoding: r.ContentEncoding,
+			Body:            r.Body,
+		})
+		if err != nil {
+			log.Warnf("AMQP: dedup reply for key %s err: %s", key, err)
+		}
+	}
+
+	if err := deliv.Ack(false); err != nil {
+		log.Warnf("AMQP: dedup ack for key %s err: %s", key, err)
+	}
+
+	return true
+}
+
+func (d *dedup) record(ctx context.Context, key string, ch *recordingChannel) {
+	r := &DedupRecord{}
+	if p := ch.reply; p != nil {
+		r.Replied = true
+		r.Exchange = ch.exchange
+		r.Key = ch.key
+		r.ContentType = p.ContentType
+		r.ContentEncoding = p.ContentEncoding
+		r.Body = p.Body
+	}
+
+	if err := d.store.Put(ctx, key, r); err != nil {
+		log.Warnf("AMQP: dedup store put key %s err: %s", key, err)
+	}
+}
+
+// recordingChannel remembers the last message published by the encoder
+type recordingChannel struct {
+	Channel
+	exchange string
+	key      string
+	reply    *amqp.Publishing
+}
+
+func (c *recordingChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if err := c.Channel.Publish(exchange, key, mandatory, immediate, msg); err != nil {
+		return err
+	}
+
+	c.exchange, c.key, c.reply = exchange, key, &msg
+	return nil
+}
+
+// MemoryDedupStore is an in-memory LRU DedupStore, records expire after TTL
+type MemoryDedupStore struct {
+	lock  sync.Mutex
+	size  int
+	ttl   time.Duration
+	lru   *list.List
+	items map[string]*list.Element
+}
+
+type memoryDedupItem struct {
+	key     string
+	record  *DedupRecord
+	expires time.Time
+}
+
+// NewMemoryDedupStore creates a store of at most size records, zero TTL means records do not expire
+func NewMemoryDedupStore(size int, ttl time.Duration) *MemoryDedupStore {
+	return &MemoryDedupStore{
+		size:  size,
+		ttl:   ttl,
+		lru:   list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// Get returns the record of the key
+func (s *MemoryDedupStore) Get(_ context.Context, key string) (*DedupRecord, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	e, ok := s.items[key]
+	if !ok {
+		return nil, nil
+	}
+
+	item := e.Value.(*memoryDedupItem)
+	if !item.expires.IsZero() && time.Now().After(item.expires) {
+		s.lru.Remove(e)
+		delete(s.items, key)
+		return nil, nil
+	}
+	s.lru.MoveToFront(e)
+
+	return item.record, nil
+}
+
+// Put stores the record of the key, the least recently used record is evicted if the store is full
+func (s *MemoryDedupStore) Put(_ context.Context, key string, r *DedupRecord) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	item := &memoryDedupItem{key: key, record: r}
+	if s.ttl > 0 {
+		item.expires = time.Now().Add(s.ttl)
+	}
+
+	if e, ok := s.items[key]; ok {
+		e.Value = item
+		s.lru.MoveToFront(e)
+		return nil
+	}
+
+	s.items[key] = s.lru.PushFront(item)
+	for s.size > 0 && s.lru.Len() > s.size {
+		e := s.lru.Back()
+		s.lru.Remove(e)
+		delete(s.items, e.Value.(*memoryDedupItem).key)
+	}
+
+	return nil
+}
@@ -0,0 +1,110 @@
+package amqp_kit
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/space307/go-utils/v3/database"
+)
+
+// SQLDedupStore is a DedupStore in a MySQL or Postgres table:
+//
+//	CREATE TABLE amqp_dedup (
+//		dedup_key        VARCHAR(255) NOT NULL PRIMARY KEY,
+//		replied          BOOLEAN NOT NULL,
+//		exchange         VARCHAR(255) NOT NULL,
+//		routing_key      VARCHAR(255) NOT NULL,
+//		content_type     VARCHAR(255) NOT NULL,
+//		content_encoding VARCHAR(255) NOT NULL,
+//		body             BLOB, -- BYTEA for Postgres
+//		created_at       BIGINT NOT NULL
+//	)
+//
+// Expired records are ignored, Cleanup deletes them.
+type SQLDedupStore struct {
+	db         *database.Database
+	ttl        time.Duration
+	getQuery   string
+	putQuery   string
+	cleanQuery string
+}
+
+// NewSQLDedupStore creates a store in the table, zero TTL means records do not expire
+func NewSQLDedupStore(db *database.Database, table string, ttl time.Duration) *SQLDedupStore {
+	p := func(n int) string { return placeholder(db.GetDriver(), n) }
+
+	return &SQLDedupStore{
+		db:  db,
+		ttl: ttl,
+		getQuery: fmt.Sprintf(`SELECT replied, exchange, routing_key, content_type, content_encoding, body `+
+			`FROM %s WHERE dedup_key = %s AND created_at > %s`, table, p(1), p(2)),
+		putQuery: fmt.Sprintf(`INSERT INTO %s (dedup_key, replied, exchange, routing_key, content_type, content_encoding, body, created_at) `+
+			`VALUES (%s)`, table, strings.Join(placeholderList(db.GetDriver(), 8), ", ")),
+		cleanQuery: fmt.Sprintf(`DELETE FROM %s WHERE created_at <= %s`, table, p(1)),
+	}
+}
+
+// Get returns the record of the key
+func (s *SQLDedupStore) Get(_ context.Context, key string) (*DedupRecord, error) {
+	rows, err := s.db.QueryRow(s.getQuery, key, s.expiredBefore())
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	r := &DedupRecord{}
+	if err = rows.Scan(&r.Replied, &r.Exchange, &r.Key, &r.ContentType, &r.ContentEncoding, &r.Body); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Put stores the record of the key, the first stored record of a key wins
+func (s *SQLDedupStore) Put(_ context.Context, key string, r *DedupRecord) error {
+	_, err := s.db.Exec(s.putQuery, key, r.Replied, r.Exchange, r.Key, r.ContentType, r.ContentEncoding, r.Body, time.Now().Unix())
+	if err != nil && database.IsErrorDuplicateKey(err) {
+		return nil
+	}
+
+	return err
+}
+
+// Cleanup deletes expired records and returns their number
+func (s *SQLDedupStore) Cleanup(_ context.Context) (int64, error) {
+	res, err := s.db.Exec(s.cleanQuery, s.expiredBefore())
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+func (s *SQLDedupStore) expiredBefore() int64 {
+	if s.ttl == 0 {
+		return 0
+	}
+	return time.Now().Add(-s.ttl).Unix()
+}
+
+// placeholder returns the n-th query parameter of the driver
+func placeholder(driver string, n int) string {
+	if driver == "postgres" {
+		return fmt.Sprintf("$%d", n)
+	}
+	return "?"
+}
+
+func placeholderList(driver string, count int) []string {
+	list := make([]string, count)
+	for i := range list {
+		list[i] = placeholder(driver, i+1)
+	}
+	return list
+}
@@ -0,0 +1,103 @@
+package amqp_kit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/space307/go-utils/v3/database"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryDedupStore(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryDedupStore(2, 20*time.Millisecond)
+
+	require.NoError(t, s.Put(ctx, "a", &DedupRecord{Body: []byte("a")}))
+	require.NoError(t, s.Put(ctx, "b", &DedupRecord{Body: []byte("b")}))
+
+	// a is used recently, so b is evicted
+	r, err := s.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("a"), r.Body)
+	require.NoError(t, s.Put(ctx, "c", &DedupRecord{}))
+
+	r, err = s.Get(ctx, "b")
+	require.NoError(t, err)
+	assert.Nil(t, r)
+
+	time.Sleep(30 * time.Millisecond)
+	r, err = s.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.Nil(t, r)
+}
+
+func TestSubscriberDedup(t *testing.T) {
+	var calls int
+	sub := NewSubscriber(
+		func(ctx context.Context, request interface{}) (interface{}, error) {
+			calls++
+			return Response{Data: calls}, nil
+		},
+		func(ctx context.Context, d *amqp.Delivery) (interface{}, error) { return nil, nil },
+		EncodeJSONResponse,
+		SubscriberAfter(SetAckAfterEndpoint(false)),
+		SubscriberDedup(NewMemoryDedupStore(10, 0), nil),
+	)
+
+	ch := &fakeChannel{}
+	fun := sub.ServeDelivery(ch)
+
+	ack := &fakeAcknowledger{}
+	fun(&amqp.Delivery{Acknowledger: ack, MessageId: "m1", ReplyTo: "reply.1", CorrelationId: "c1"})
+	fun(&amqp.Delivery{Acknowledger: ack, MessageId: "m1", ReplyTo: "reply.2", CorrelationId: "c2"})
+
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, 2, ack.acks)
+	require.Len(t, ch.published, 2)
+	assert.Equal(t, "reply.2", ch.published[1].key)
+	assert.Equal(t, "c2", ch.published[1].msg.CorrelationId)
+	assert.Equal(t, ch.published[0].msg.Body, ch.published[1].msg.Body)
+
+	// deliveries without a key are not deduplicated
+	fun(&amqp.Delivery{Acknowledger: ack})
+	fun(&amqp.Delivery{Acknowledger: ack})
+	assert.Equal(t, 3, calls)
+}
+
+func TestSQLDedupStore(t *testing.T) {
+	db, err := database.InitDatabase(&database.Config{
+		Addr:     "127.0.0.1:3306",
+		User:     "travis",
+		Database: "db_test",
+	})
+	require.NoError(t, err)
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS amqp_dedup (dedup_key VARCHAR(255) NOT NULL PRIMARY KEY, " +
+		"replied BOOLEAN NOT NULL, exchange VARCHAR(255) NOT NULL, routing_key VARCHAR(255) NOT NULL, " +
+		"content_type VARCHAR(255) NOT NULL, content_encoding VARCHAR(255) NOT NULL, body BLOB, created_at BIGINT NOT NULL)")
+	require.NoError(t, err)
+	_, err = db.Exec("DELETE FROM amqp_dedup")
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	s := NewSQLDedupStore(db, "amqp_dedup", time.Hour)
+
+	r, err := s.Get(ctx, "k")
+	require.NoError(t, err)
+	assert.Nil(t, r)
+
+	rec := &DedupRecord{Replied: true, Key: "reply", ContentType: ContentTypeJSON, Body: []byte(`{}`)}
+	require.NoError(t, s.Put(ctx, "k", rec))
+	require.NoError(t, s.Put(ctx, "k", &DedupRecord{}))
+
+	r, err = s.Get(ctx, "k")
+	require.NoError(t, err)
+	assert.Equal(t, rec, r)
+}
+
+func TestPlaceholder(t *testing.T) {
+	assert.Equal(t, []string{"?", "?"}, placeholderList("mysql", 2))
+	assert.Equal(t, []string{"$1", "$2"}, placeholderList("postgres", 2))
+}
@@ -0,0 +1,50 @@
+package amqp_kit
+
+import (
+	"github.com/streadway/amqp"
+)
+
+// AMQPChannel is the part of *amqp.Channel used by Client
+type AMQPChannel interface {
+	Channel
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueInspect(name string) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	Cancel(consumer string, noWait bool) error
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyReturn(c chan amqp.Return) chan amqp.Return
+	NotifyClose(c chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+// AMQPConnection is the part of *amqp.Connection used by Client
+type AMQPConnection interface {
+	Channel() (AMQPChannel, error)
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	NotifyBlocked(receiver chan amqp.Blocking) chan amqp.Blocking
+	Close() error
+}
+
+// Dialer opens a connection to the node addr, see amqptest.Broker for an in-memory one
+type Dialer func(c *Config, addr string) (AMQPConnection, error)
+
+// ClientDialer sets the dialer of the client, by default connections are opened by amqp.DialConfig.
+func ClientDialer(d Dialer) ClientOption {
+	return func(c *Client) { c.dialer = d }
+}
+
+// amqpConnection adapts *amqp.Connection to AMQPConnection
+type amqpConnection struct {
+	*amqp.Connection
+}
+
+func (c amqpConnection) Channel() (AMQPChannel, error) {
+	ch, err := c.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
@@ -0,0 +1,158 @@
+package amqp_kit
+
+import (
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// Ordering is the order of handling deliveries of one consumer by concurrent workers
+type Ordering int
+
+const (
+	// OrderUnordered handles every delivery by any free worker
+	OrderUnordered Ordering = iota
+	// OrderPerKey handles deliveries with the same partition key one by one in order of delivery,
+	// deliveries with other keys are handled by free workers meanwhile
+	OrderPerKey
+	// OrderStrict handles all deliveries one by one in order of delivery, Concurrency is ignored
+	OrderStrict
+)
+
+// dispatcher hands deliveries of a consumer to a pool of goroutines
+type dispatcher struct {
+	queue chan *amqp.Delivery
+	keys  *keyQueue
+	wg    sync.WaitGroup
+}
+
+func newDispatcher(concurrency int, ordering Ordering, key func(d *amqp.Delivery) string, handle func(d *amqp.Delivery)) *dispatcher {
+	if concurrency < 1 || ordering == OrderStrict {
+		concurrency = 1
+	}
+	if key == nil {
+		key = routingKey
+	}
+
+	d := &dispatcher{}
+	worker := func() {
+		defer d.wg.Done()
+		for deliv := range d.queue {
+			handle(deliv)
+		}
+	}
+	// per-key workers share the queue of keys, so a slow key does not hold up other keys
+	if ordering == OrderPerKey {
+		d.keys = newKeyQueue(key)
+		worker = func() {
+			defer d.wg.Done()
+			d.keys.work(handle)
+		}
+	} else {
+		d.queue = make(chan *amqp.Delivery)
+	}
+
+	d.wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go worker()
+	}
+
+	return d
+}
+
+// dispatch blocks until a worker takes the delivery. Per-key deliveries are queued
+// behind the delivery with the same key, their number is limited by the prefetch.
+func (d *dispatcher) dispatch(deliv *amqp.Delivery) {
+	if d.keys != nil {
+		d.keys.push(deliv)
+		return
+	}
+
+	d.queue <- deliv
+}
+
+// close waits for workers to handle dispatched deliveries
+func (d *dispatcher) close() {
+	if d.keys != nil {
+		d.keys.close()
+	} else {
+		close(d.queue)
+	}
+	d.wg.Wait()
+}
+
+// keyQueue keeps deliveries by partition key, a key is handled by one worker at a time
+type keyQueue struct {
+	lock sync.Mutex
+	cond *sync.Cond
+	key  func(d *amqp.Delivery) string
+	// pending are deliveries not handled yet, a key is present while its delivery is handled
+	pending map[string][]*amqp.Delivery
+	// ready are keys with pending deliveries and without a worker in order of arrival
+	ready  []string
+	closed bool
+}
+
+func newKeyQueue(key func(d *amqp.Delivery) string) *keyQueue {
+	q := &keyQueue{key: key, pending: make(map[string][]*amqp.Delivery)}
+	q.cond = sync.NewCond(&q.lock)
+	return q
+}
+
+func (q *keyQueue) push(d *amqp.Delivery) {
+	key := q.key(d)
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	list, active := q.pending[key]
+	q.pending[key] = append(list, d)
+	if !active {
+		q.ready = append(q.ready, key)
+		q.cond.Signal()
+	}
+}
+
+// work handles ready keys until the queue is closed and drained
+func (q *keyQueue) work(handle func(d *amqp.Delivery)) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for {
+		for len(q.ready) == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if len(q.ready) == 0 {
+			return
+		}
+
+		key := q.ready[0]
+		q.ready = q.ready[1:]
+		d := q.pending[key][0]
+		q.pending[key] = q.pending[key][1:]
+
+		q.lock.Unlock()
+		handle(d)
+		q.lock.Lock()
+
+		if len(q.pending[key]) > 0 {
+			q.ready = append(q.ready, key)
+			q.cond.Signal()
+		} else {
+			delete(q.pending, key)
+		}
+	}
+}
+
+// close wakes up workers, they exit after pending deliveries are handled
+func (q *keyQueue) close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+func routingKey(d *amqp.Delivery) string {
+	return d.RoutingKey
+}
@@ -0,0 +1,112 @@
+package amqp_kit
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDispatcherUnordered(t *testing.T) {
+	var running, maxRunning int32
+	d := newDispatcher(4, OrderUnordered, nil, func(d *amqp.Delivery) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+	})
+
+	for i := 0; i < 8; i++ {
+		d.dispatch(&amqp.Delivery{})
+	}
+	d.close()
+
+	assert.Equal(t, int32(4), maxRunning)
+}
+
+func TestDispatcherPerKey(t *testing.T) {
+	var (
+		lock sync.Mutex
+		seen = make(map[string][]int)
+	)
+	d := newDispatcher(3, OrderPerKey, nil, func(d *amqp.Delivery) {
+		n, _ := strconv.Atoi(string(d.Body))
+		lock.Lock()
+		seen[d.RoutingKey] = append(seen[d.RoutingKey], n)
+		lock.Unlock()
+	})
+
+	for i := 0; i < 30; i++ {
+		d.dispatch(&amqp.Delivery{RoutingKey: "key." + strconv.Itoa(i%5), Body: []byte(strconv.Itoa(i))})
+	}
+	d.close()
+
+	assert.Len(t, seen, 5)
+	for key, ns := range seen {
+		assert.Len(t, ns, 6, key)
+		for i := 1; i < len(ns); i++ {
+			assert.True(t, ns[i-1] < ns[i], key)
+		}
+	}
+}
+
+func TestDispatcherPerKeySlowKey(t *testing.T) {
+	slow := make(chan struct{})
+	handled := make(chan string, 10)
+	d := newDispatcher(2, OrderPerKey, nil, func(d *amqp.Delivery) {
+		if d.RoutingKey == `slow` {
+			<-slow
+		}
+		handled <- d.RoutingKey
+	})
+
+	d.dispatch(&amqp.Delivery{RoutingKey: `slow`})
+	d.dispatch(&amqp.Delivery{RoutingKey: `slow`})
+	// other keys are handled by the free worker while the slow key is busy
+	for i := 0; i < 5; i++ {
+		d.dispatch(&amqp.Delivery{RoutingKey: `fast.` + strconv.Itoa(i)})
+	}
+	for i := 0; i < 5; i++ {
+		select {
+		case key := <-handled:
+			assert.NotEqual(t, `slow`, key)
+		case <-time.After(time.Second):
+			t.Fatal("fast key is blocked by the slow key")
+		}
+	}
+
+	close(slow)
+	d.close()
+	assert.Len(t, handled, 2)
+}
+
+func TestDispatcherStrict(t *testing.T) {
+	var got []int
+	d := newDispatcher(4, OrderStrict, nil, func(d *amqp.Delivery) {
+		n, _ := strconv.Atoi(string(d.Body))
+		got = append(got, n)
+	})
+
+	for i := 0; i < 10; i++ {
+		d.dispatch(&amqp.Delivery{Body: []byte(strconv.Itoa(i))})
+	}
+	d.close()
+
+	assert.Equal(t, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, got)
+}
+
+func TestSubscribeInfoPrefetch(t *testing.T) {
+	assert.Equal(t, 1, (&SubscribeInfo{}).prefetch())
+	assert.Equal(t, 8, (&SubscribeInfo{Concurrency: 8}).prefetch())
+	assert.Equal(t, 1, (&SubscribeInfo{Concurrency: 8, Ordering: OrderStrict}).prefetch())
+	assert.Equal(t, 20, (&SubscribeInfo{Concurrency: 8, Prefetch: 20}).prefetch())
+}
@@ -3,16 +3,47 @@ package amqp_kit
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 
 	"github.com/streadway/amqp"
 )
 
+var (
+	// ErrPublishNack is returned by Publish when the broker nacks a message in confirm mode
+	ErrPublishNack = errors.New("amqp_kit: message was nacked by broker")
+	// ErrConfirmTimeout is returned by Publish when the broker does not confirm a message in time
+	ErrConfirmTimeout = errors.New("amqp_kit: publisher confirm timeout")
+	// ErrBufferFull is returned by Publish when the outbound buffer is full and BufferFail policy is used
+	ErrBufferFull = errors.New("amqp_kit: outbound buffer is full")
+	// ErrUnroutable is returned by Publish when a mandatory message is returned by the broker
+	ErrUnroutable = errors.New("amqp_kit: message is unroutable")
+	// ErrClientClosed is returned by Publish when the client is closed while the message is buffered
+	ErrClientClosed = errors.New("amqp_kit: client is closed")
+	// ErrOutboxUnconfirmed is returned by Outbox.Relay when the client does not wait for publisher confirms
+	ErrOutboxUnconfirmed = errors.New("amqp_kit: outbox relay requires PublishConfirm without OutboundBuffer")
+)
+
+// ErrorClass tells how a failed delivery should be settled
+type ErrorClass int
+
+const (
+	// ErrorUnclassified is a class of errors classified by StatusCode
+	ErrorUnclassified ErrorClass = iota
+	// ErrorRetryable is a class of temporary errors, the delivery may succeed later
+	ErrorRetryable
+	// ErrorPermanent is a class of errors which repeat on every delivery of the message
+	ErrorPermanent
+	// ErrorPoison is a class of malformed messages, which should be dead-lettered
+	ErrorPoison
+)
+
 // Error struct contain message, code message and http status code for amqp response
 type Error struct {
-	Code       string `json:"code"`
-	Message    string `json:"message"`
-	StatusCode int    `json:"status_code"`
+	Code       string     `json:"code"`
+	Message    string     `json:"message"`
+	StatusCode int        `json:"status_code"`
+	Class      ErrorClass `json:"-"`
 }
 
 // Error returns error message.
@@ -25,9 +56,43 @@ func NewError(message string, code string, statusCode int) *Error {
 	return &Error{Message: message, Code: code, StatusCode: statusCode}
 }
 
+// NewRetryableError creates an error of the ErrorRetryable class
+func NewRetryableError(message string, code string, statusCode int) *Error {
+	return &Error{Message: message, Code: code, StatusCode: statusCode, Class: ErrorRetryable}
+}
+
+// NewPoisonError creates an error of the ErrorPoison class
+func NewPoisonError(message string, code string, statusCode int) *Error {
+	return &Error{Message: message, Code: code, StatusCode: statusCode, Class: ErrorPoison}
+}
+
 // WrapError use for rewrite message for base amqp Error struct
 func WrapError(e *Error, errMessage string) *Error {
-	return &Error{Message: errMessage, Code: e.Code, StatusCode: e.StatusCode}
+	return &Error{Message: errMessage, Code: e.Code, StatusCode: e.StatusCode, Class: e.Class}
+}
+
+// ClassifyError returns the class of the error. Error without a class is classified by StatusCode:
+// 408, 429 and 5xx are retryable, others are permanent. Panics and decode errors are poison,
+// context deadline and other errors are retryable as they are replied with 500 status.
+func ClassifyError(err error) ErrorClass {
+	switch e := err.(type) {
+	case *Error:
+		if e.Class != ErrorUnclassified {
+			return e.Class
+		}
+		switch {
+		case e.StatusCode == http.StatusRequestTimeout, e.StatusCode == http.StatusTooManyRequests:
+			return ErrorRetryable
+		case e.StatusCode >= http.StatusInternalServerError:
+			return ErrorRetryable
+		default:
+			return ErrorPermanent
+		}
+	case *PanicError, *DecodeError:
+		return ErrorPoison
+	default:
+		return ErrorRetryable
+	}
 }
 
 // ErrorEncoder is responsible for encoding an error to the subscriber reply.
@@ -38,17 +103,6 @@ type ErrorEncoder func(ctx context.Context, err error, d *amqp.Delivery, ch Chan
 
 // ReplyErrorWithCodeEncoder base decoder for error response
 func ReplyErrorWithCodeEncoder(ctx context.Context, err error, d *amqp.Delivery, ch Channel, pub *amqp.Publishing) {
-
-	if pub.CorrelationId == "" {
-		pub.CorrelationId = d.CorrelationId
-	}
-
-	replyExchange := getPublishExchange(ctx)
-	replyTo := getPublishKey(ctx)
-	if replyTo == "" {
-		replyTo = d.ReplyTo
-	}
-
 	e, ok := err.(*Error)
 	if !ok {
 		e = NewError(err.Error(), ``, http.StatusInternalServerError)
@@ -58,9 +112,8 @@ func ReplyErrorWithCodeEncoder(ctx context.Context, err error, d *amqp.Delivery,
 	if err != nil {
 		return
 	}
-	pub.Body = b
 
-	ch.Publish(replyExchange, replyTo, false, false, *pub)
+	publishReply(ctx, d, ch, pub, ContentTypeJSON, b)
 }
 
 // ReplyAndAckErrorWithCodeEncoder call ReplyErrorWithCodeEncoder method and Ack delivery message
@@ -69,6 +122,48 @@ func ReplyAndAckErrorWithCodeEncoder(ctx context.Context, err error, d *amqp.Del
 	d.Ack(false)
 }
 
+// NackErrorEncoder returns an ErrorEncoder, which nacks the delivery without a reply.
+// If requeue is false, the delivery is dead-lettered or dropped.
+func NackErrorEncoder(requeue bool) ErrorEncoder {
+	return func(ctx context.Context, err error, d *amqp.Delivery, ch Channel, pub *amqp.Publishing) {
+		d.Nack(false, requeue)
+	}
+}
+
+// ReplyAndNackErrorWithCodeEncoder returns an ErrorEncoder, which calls ReplyErrorWithCodeEncoder
+// method and nacks the delivery. If requeue is false, the delivery is dead-lettered or dropped.
+func ReplyAndNackErrorWithCodeEncoder(requeue bool) ErrorEncoder {
+	return func(ctx context.Context, err error, d *amqp.Delivery, ch Channel, pub *amqp.Publishing) {
+		ReplyErrorWithCodeEncoder(ctx, err, d, ch, pub)
+		d.Nack(false, requeue)
+	}
+}
+
+// ClassErrorEncoder returns an ErrorEncoder, which calls the encoder of the ClassifyError class
+func ClassErrorEncoder(retryable, permanent, poison ErrorEncoder) ErrorEncoder {
+	return func(ctx context.Context, err error, d *amqp.Delivery, ch Channel, pub *amqp.Publishing) {
+		switch ClassifyError(err) {
+		case ErrorRetryable:
+			retryable(ctx, err, d, ch, pub)
+		case ErrorPoison:
+			poison(ctx, err, d, ch, pub)
+		default:
+			permanent(ctx, err, d, ch, pub)
+		}
+	}
+}
+
+// ReplyByClassErrorEncoder requeues the delivery on retryable errors without a reply,
+// replies and acks on permanent errors, replies and nacks to the dead-letter exchange on poison errors.
+// Without SubscriberRetry retryable errors are redelivered without a limit. With SubscriberRetry
+// the encoder is called for retryable errors only after the delivery is parked and acked,
+// so the requeue is ignored and the delivery is not redelivered.
+var ReplyByClassErrorEncoder = ClassErrorEncoder(
+	NackErrorEncoder(true),
+	ReplyAndAckErrorWithCodeEncoder,
+	ReplyAndNackErrorWithCodeEncoder(false),
+)
+
 // Response base response object with data and error field
 type Response struct {
 	Data  interface{} `json:"data,omitempty"`
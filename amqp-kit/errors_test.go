@@ -2,6 +2,7 @@ package amqp_kit
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"testing"
 	"time"
@@ -33,6 +34,61 @@ func TestErrorWithCode_Error(t *testing.T) {
 	assert.Equal(t, `test message`, e.Error())
 }
 
+func TestClassifyError(t *testing.T) {
+	assert.Equal(t, ErrorPermanent, ClassifyError(NewError(`bad request`, ``, http.StatusBadRequest)))
+	assert.Equal(t, ErrorRetryable, ClassifyError(NewError(`too many`, ``, http.StatusTooManyRequests)))
+	assert.Equal(t, ErrorRetryable, ClassifyError(NewError(`unavailable`, ``, http.StatusServiceUnavailable)))
+	assert.Equal(t, ErrorRetryable, ClassifyError(NewRetryableError(`locked`, ``, http.StatusConflict)))
+	assert.Equal(t, ErrorPoison, ClassifyError(NewPoisonError(`malformed`, ``, http.StatusBadRequest)))
+	assert.Equal(t, ErrorPoison, ClassifyError(WrapError(NewPoisonError(`malformed`, ``, http.StatusBadRequest), `wrapped`)))
+	assert.Equal(t, ErrorPoison, ClassifyError(&PanicError{Value: `panic`}))
+	assert.Equal(t, ErrorPoison, ClassifyError(&DecodeError{Err: errors.New(`bad json`)}))
+	assert.Equal(t, ErrorRetryable, ClassifyError(context.DeadlineExceeded))
+}
+
+func TestReplyByClassErrorEncoder(t *testing.T) {
+	for _, tc := range []struct {
+		err     error
+		replied bool
+		acks    int
+		nacks   int
+		requeue bool
+	}{
+		{err: NewError(`unavailable`, ``, http.StatusServiceUnavailable), nacks: 1, requeue: true},
+		{err: NewError(`bad request`, ``, http.StatusBadRequest), replied: true, acks: 1},
+		{err: NewPoisonError(`malformed`, ``, http.StatusBadRequest), replied: true, nacks: 1},
+	} {
+		ch := &fakeChannel{}
+		ack := &fakeAcknowledger{}
+		d := &amqp.Delivery{Acknowledger: ack, ReplyTo: `reply`, CorrelationId: `cor`}
+
+		ReplyByClassErrorEncoder(context.Background(), tc.err, d, ch, &amqp.Publishing{})
+
+		assert.Equal(t, tc.replied, len(ch.published) == 1, tc.err.Error())
+		assert.Equal(t, tc.acks, ack.acks, tc.err.Error())
+		assert.Equal(t, tc.nacks, ack.nacks, tc.err.Error())
+		assert.Equal(t, tc.requeue, ack.requeue, tc.err.Error())
+	}
+}
+
+func TestSubscriberDecodeErrorIsPoison(t *testing.T) {
+	sub := NewSubscriber(
+		func(ctx context.Context, request interface{}) (interface{}, error) { return nil, nil },
+		DecodeRequest(struct{}{}),
+		EncodeNopResponse,
+		SubscriberErrorEncoder(ReplyByClassErrorEncoder),
+	)
+
+	ch := &fakeChannel{}
+	ack := &fakeAcknowledger{}
+	sub.ServeDelivery(ch)(&amqp.Delivery{Acknowledger: ack, ReplyTo: `reply`, Body: []byte(`{bad`)})
+
+	// the malformed message is replied and dead-lettered instead of requeued
+	assert.Len(t, ch.published, 1)
+	assert.Equal(t, 1, ack.nacks)
+	assert.False(t, ack.requeue)
+}
+
 type errSuite struct {
 	suite.Suite
 	config *Config
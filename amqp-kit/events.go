@@ -0,0 +1,100 @@
+package amqp_kit
+
+import (
+	"math"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	defaultReconnectMaxDuration = 30 * time.Second
+	defaultReconnectMultiplier  = 2
+)
+
+const (
+	// StateDisconnected is a state of a client before the first connection.
+	StateDisconnected int32 = 0
+	// StateConnected is a state when the connection is open.
+	StateConnected int32 = 1
+	// StateReconnecting is a state after the connection was lost.
+	StateReconnecting int32 = 2
+	// StateClosed is a state after a call to Close or Shutdown.
+	StateClosed int32 = 3
+)
+
+// hooks are callbacks for connection lifecycle events
+type hooks struct {
+	onDisconnect       func(err error)
+	onReconnect        func(attempts int, downtime time.Duration)
+	onConsumerRestored func(queue string)
+	onBlocked          func(b amqp.Blocking)
+	onReturn           func(r amqp.Return)
+	onBufferDrop       func(exchange, key string, pub amqp.Publishing, err error)
+}
+
+// ClientOption sets an optional parameter for clients.
+type ClientOption func(*Client)
+
+// OnDisconnect is called when the connection is lost, before reconnecting.
+func OnDisconnect(f func(err error)) ClientOption {
+	return func(c *Client) { c.hooks.onDisconnect = f }
+}
+
+// OnReconnect is called when the connection is established again
+// with the number of attempts and the time since the connection was lost.
+func OnReconnect(f func(attempts int, downtime time.Duration)) ClientOption {
+	return func(c *Client) { c.hooks.onReconnect = f }
+}
+
+// OnConsumerRestored is called when a consumer of the queue is started again after its channel was closed.
+func OnConsumerRestored(f func(queue string)) ClientOption {
+	return func(c *Client) { c.hooks.onConsumerRestored = f }
+}
+
+// OnBlocked is called when the broker blocks or unblocks the connection, see amqp.Connection.NotifyBlocked.
+func OnBlocked(f func(b amqp.Blocking)) ClientOption {
+	return func(c *Client) { c.hooks.onBlocked = f }
+}
+
+// OnReturn is called for messages returned by the broker as unroutable when Config.PublishMandatory
+// is set without PublishConfirm. In confirm mode Publish returns ErrUnroutable instead.
+func OnReturn(f func(r amqp.Return)) ClientOption {
+	return func(c *Client) { c.hooks.onReturn = f }
+}
+
+// OnBufferDrop is called for every message dropped from the outbound buffer with the reason:
+// ErrBufferFull for BufferDropOldest, ErrClientClosed for Close or the error of the last publish attempt.
+func OnBufferDrop(f func(exchange, key string, pub amqp.Publishing, err error)) ClientOption {
+	return func(c *Client) { c.hooks.onBufferDrop = f }
+}
+
+// State returns the connection state of the client.
+func (c *Client) State() int32 {
+	return atomic.LoadInt32(&c.state)
+}
+
+func (c *Client) setState(state int32) {
+	atomic.StoreInt32(&c.state, state)
+}
+
+// reconnectDelay returns exponential backoff with jitter for the attempt, attempts start with 1
+func (c *Client) reconnectDelay(attempt int) time.Duration {
+	base, max, multiplier := c.config.ReconnectAfterDuration, c.config.ReconnectMaxDuration, c.config.ReconnectMultiplier
+	if base == 0 {
+		base = defaultReconnectAfterDuration
+	}
+	if max == 0 {
+		max = defaultReconnectMaxDuration
+	}
+	if multiplier == 0 {
+		multiplier = defaultReconnectMultiplier
+	}
+
+	d := math.Min(float64(base)*math.Pow(multiplier, float64(attempt-1)), float64(max))
+
+	// spread reconnects of many clients after a broker restart
+	return time.Duration(d/2 + rand.Float64()*d/2)
+}
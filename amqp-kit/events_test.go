@@ -0,0 +1,86 @@
+package amqp_kit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReconnectDelay(t *testing.T) {
+	cl := &Client{config: &Config{ReconnectAfterDuration: time.Second, ReconnectMaxDuration: 5 * time.Second}}
+
+	for attempt, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		d := cl.reconnectDelay(attempt + 1)
+		assert.True(t, d >= max/2 && d <= max, "attempt %d, delay %s", attempt+1, d)
+	}
+}
+
+func TestOnCloseWithErrStopped(t *testing.T) {
+	var disconnected bool
+	cl := &Client{config: &Config{}, stopClientChan: make(chan struct{})}
+	OnDisconnect(func(err error) { disconnected = true })(cl)
+
+	close(cl.stopClientChan)
+	cl.onCloseWithErr(nil, errors.New("closed"))
+
+	assert.False(t, disconnected)
+	assert.Equal(t, StateDisconnected, cl.State())
+}
+
+func (s *apiSuite) TestReconnectHooks() {
+	disconnected := make(chan error, 1)
+	reconnected := make(chan int, 1)
+	restored := make(chan string, 1)
+
+	cl, err := New(s.config,
+		OnDisconnect(func(err error) { disconnected <- err }),
+		OnReconnect(func(attempts int, downtime time.Duration) { reconnected <- attempts }),
+		OnConsumerRestored(func(queue string) { restored <- queue }),
+	)
+	s.Require().NoError(err)
+	s.Equal(StateConnected, cl.State())
+
+	s.Require().NoError(cl.Serve([]SubscribeInfo{
+		{
+			Queue:    `hooks`,
+			Exchange: `exc`,
+			E: func(ctx context.Context, request interface{}) (response interface{}, err error) {
+				return nil, nil
+			},
+			Dec: func(i context.Context, delivery *amqp.Delivery) (request interface{}, err error) {
+				return nil, nil
+			},
+			Enc: EncodeNopResponse,
+		},
+	}))
+
+	s.Require().NoError(cl.GetAMQPConnection().Close())
+
+	select {
+	case <-disconnected:
+	case <-time.After(5 * time.Second):
+		s.FailNow("timeout. waiting OnDisconnect")
+	}
+
+	select {
+	case attempts := <-reconnected:
+		s.True(attempts > 0)
+	case <-time.After(10 * time.Second):
+		s.FailNow("timeout. waiting OnReconnect")
+	}
+
+	select {
+	case q := <-restored:
+		s.Equal(`hooks`, q)
+	case <-time.After(10 * time.Second):
+		s.FailNow("timeout. waiting OnConsumerRestored")
+	}
+	s.Equal(StateConnected, cl.State())
+
+	s.Require().NoError(cl.Close())
+	s.Equal(StateClosed, cl.State())
+}
@@ -0,0 +1,155 @@
+package amqp_kit
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/space307/go-utils/v3/checker"
+	"github.com/streadway/amqp"
+)
+
+// Health is a health report of the client
+type Health struct {
+	// State is the connection state, see StateConnected
+	State int32
+	// Node is the address of the connected broker node
+	Node string
+	// SinceConnect is the time since the connection was established or restored
+	SinceConnect time.Duration
+	// Queues are reports of subscribed queues sorted by name
+	Queues []QueueHealth
+}
+
+// QueueHealth is a health report of a subscribed queue
+type QueueHealth struct {
+	Queue string
+	// Expected is the number of consumers of the subscription, SubscribeInfo.Workers
+	Expected int
+	// Running is the number of consumers started by the client
+	Running int
+	// Consumers is the number of consumers of the queue reported by the broker, including other clients
+	Consumers int
+	// Messages is the number of ready messages reported by the broker
+	Messages int
+	// MaxBacklog is SubscribeInfo.MaxBacklog, zero means no limit
+	MaxBacklog int
+	// Err is the error of the queue inspection
+	Err error
+}
+
+// Err returns an error describing every problem of the report or nil if the client is healthy
+func (h *Health) Err() error {
+	var problems []string
+	if h.State != StateConnected {
+		problems = append(problems, fmt.Sprintf("connection state %d", h.State))
+	}
+
+	for _, q := range h.Queues {
+		switch {
+		case q.Err != nil:
+			problems = append(problems, fmt.Sprintf("queue %s inspect err: %s", q.Queue, q.Err))
+		case q.Running < q.Expected:
+			problems = append(problems, fmt.Sprintf("queue %s has %d of %d consumers running", q.Queue, q.Running, q.Expected))
+		case q.Consumers < q.Expected:
+			problems = append(problems, fmt.Sprintf("queue %s has %d of %d consumers on broker", q.Queue, q.Consumers, q.Expected))
+		}
+		if q.MaxBacklog > 0 && q.Messages > q.MaxBacklog {
+			problems = append(problems, fmt.Sprintf("queue %s backlog %d exceeds %d", q.Queue, q.Messages, q.MaxBacklog))
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("AMQP: unhealthy: %s", strings.Join(problems, "; "))
+}
+
+// Health inspects subscribed queues and returns the health report
+func (c *Client) Health() *Health {
+	conn := c.getConnection()
+	h := &Health{
+		State: c.State(),
+		Node:  conn.addr,
+	}
+	if connected := atomic.LoadInt64(&c.connectedAt); connected > 0 {
+		h.SinceConnect = time.Since(time.Unix(0, connected))
+	}
+
+	subs := c.subscriptions()
+	queues := make([]string, len(subs))
+	for i, s := range subs {
+		queues[i] = s.si.Queue
+	}
+
+	c.inspectQueues(queues, func(i int, info amqp.Queue, err error) {
+		s := subs[i]
+		h.Queues = append(h.Queues, QueueHealth{
+			Queue:      s.si.Queue,
+			Expected:   s.si.Workers,
+			Running:    s.Status().Consumers,
+			Consumers:  info.Consumers,
+			Messages:   info.Messages,
+			MaxBacklog: s.si.MaxBacklog,
+			Err:        err,
+		})
+	})
+
+	return h
+}
+
+// subscriptions returns running subscriptions sorted by queue
+func (c *Client) subscriptions() []*subscription {
+	c.subsLock.Lock()
+	subs := make([]*subscription, 0, len(c.subs))
+	for _, s := range c.subs {
+		if !s.stopped() {
+			subs = append(subs, s)
+		}
+	}
+	c.subsLock.Unlock()
+
+	sort.Slice(subs, func(i, j int) bool { return subs[i].si.Queue < subs[j].si.Queue })
+	return subs
+}
+
+// inspectQueues calls f with the broker state of every queue in order.
+// Queues are inspected through a channel out of the pool.
+func (c *Client) inspectQueues(queues []string, f func(i int, info amqp.Queue, err error)) {
+	conn := c.getConnection()
+
+	var ch AMQPChannel
+	defer func() {
+		if ch != nil {
+			_ = ch.Close()
+		}
+	}()
+
+	for i, queue := range queues {
+		var (
+			info amqp.Queue
+			err  error
+		)
+		if ch == nil {
+			ch, err = conn.openChan()
+		}
+		if err == nil {
+			if info, err = ch.QueueInspect(queue); err != nil {
+				// the broker closes the channel on a failed inspection
+				_ = ch.Close()
+				ch = nil
+			}
+		}
+
+		f(i, info, err)
+	}
+}
+
+// HealthCheckup returns a checkup failing when the client is not healthy, see Health.Err
+func HealthCheckup(c *Client) checker.Checkup {
+	return func() error {
+		return c.Health().Err()
+	}
+}
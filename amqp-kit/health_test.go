@@ -0,0 +1,25 @@
+package amqp_kit
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthErr(t *testing.T) {
+	h := &Health{State: StateConnected, Queues: []QueueHealth{{Queue: `q`, Expected: 2, Running: 2, Consumers: 3}}}
+	assert.NoError(t, h.Err())
+
+	h = &Health{State: StateReconnecting, Queues: []QueueHealth{
+		{Queue: `died`, Expected: 2, Running: 1, Consumers: 1},
+		{Queue: `lost`, Expected: 1, Running: 1},
+		{Queue: `missing`, Expected: 1, Running: 1, Err: errors.New("not found")},
+		{Queue: `backlog`, Expected: 1, Running: 1, Consumers: 1, Messages: 11, MaxBacklog: 10},
+	}}
+	assert.EqualError(t, h.Err(), "AMQP: unhealthy: connection state 2; "+
+		"queue died has 1 of 2 consumers running; "+
+		"queue lost has 0 of 1 consumers on broker; "+
+		"queue missing inspect err: not found; "+
+		"queue backlog backlog 11 exceeds 10")
+}
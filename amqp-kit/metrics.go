@@ -0,0 +1,209 @@
+package amqp_kit
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/streadway/amqp"
+)
+
+const (
+	// OutcomeAck is the outcome of an acked delivery
+	OutcomeAck = "ack"
+	// OutcomeNack is the outcome of a nacked delivery
+	OutcomeNack = "nack"
+	// OutcomeReject is the outcome of a rejected delivery
+	OutcomeReject = "reject"
+	// OutcomeNone is the outcome of a delivery not settled by the handler
+	OutcomeNone = "none"
+)
+
+// Metrics contains collectors for publish and consume paths
+type Metrics struct {
+	publishCount      metrics.Counter
+	publishLatency    metrics.Histogram
+	deliveryCount     metrics.Counter
+	deliveryLatency   metrics.Histogram
+	channelPoolSize   metrics.Gauge
+	channelPoolMisses metrics.Counter
+	reconnectCount    metrics.Counter
+	consumerCount     metrics.Gauge
+	bufferSize        metrics.Gauge
+	bufferDrops       metrics.Counter
+	queueMessages     metrics.Gauge
+	queueConsumers    metrics.Gauge
+}
+
+var (
+	prometheusMetrics     *Metrics
+	prometheusMetricsOnce sync.Once
+)
+
+// NewMetrics returns collectors registered in the default prometheus registry.
+// Collectors are registered once, every call returns the same object.
+func NewMetrics() *Metrics {
+	prometheusMetricsOnce.Do(func() {
+		prometheusMetrics = &Metrics{
+			publishCount: kitprometheus.NewCounterFrom(prometheus.CounterOpts{
+				Name: "amqp_publish_count",
+				Help: "Number of published messages",
+			}, []string{"exchange", "key", "error"}),
+			publishLatency: kitprometheus.NewHistogramFrom(prometheus.HistogramOpts{
+				Name: "amqp_publish_latency_seconds",
+				Help: "Duration of publishing in seconds",
+			}, []string{"exchange", "key", "error"}),
+			deliveryCount: kitprometheus.NewCounterFrom(prometheus.CounterOpts{
+				Name: "amqp_delivery_count",
+				Help: "Number of handled deliveries",
+			}, []string{"queue", "outcome"}),
+			deliveryLatency: kitprometheus.NewHistogramFrom(prometheus.HistogramOpts{
+				Name: "amqp_delivery_latency_seconds",
+				Help: "Duration of delivery handling in seconds",
+			}, []string{"queue"}),
+			channelPoolSize: kitprometheus.NewGaugeFrom(prometheus.GaugeOpts{
+				Name: "amqp_channel_pool_size",
+				Help: "Number of idle channels in the pool",
+			}, []string{}),
+			channelPoolMisses: kitprometheus.NewCounterFrom(prometheus.CounterOpts{
+				Name: "amqp_channel_pool_misses",
+				Help: "Number of channels opened because the pool was empty",
+			}, []string{}),
+			reconnectCount: kitprometheus.NewCounterFrom(prometheus.CounterOpts{
+				Name: "amqp_reconnect_count",
+				Help: "Number of reconnects",
+			}, []string{}),
+			consumerCount: kitprometheus.NewGaugeFrom(prometheus.GaugeOpts{
+				Name: "amqp_consumer_count",
+				Help: "Number of running consumers",
+			}, []string{"queue"}),
+			bufferSize: kitprometheus.NewGaugeFrom(prometheus.GaugeOpts{
+				Name: "amqp_outbound_buffer_size",
+				Help: "Number of messages waiting in the outbound buffer",
+			}, []string{}),
+			bufferDrops: kitprometheus.NewCounterFrom(prometheus.CounterOpts{
+				Name: "amqp_outbound_buffer_drops",
+				Help: "Number of messages dropped from the outbound buffer",
+			}, []string{}),
+			queueMessages: kitprometheus.NewGaugeFrom(prometheus.GaugeOpts{
+				Name: "amqp_queue_messages",
+				Help: "Number of ready messages in the queue",
+			}, []string{"queue"}),
+			queueConsumers: kitprometheus.NewGaugeFrom(prometheus.GaugeOpts{
+				Name: "amqp_queue_consumers",
+				Help: "Number of consumers of the queue",
+			}, []string{"queue"}),
+		}
+	})
+
+	return prometheusMetrics
+}
+
+// ClientMetrics sets collectors for the client, its pool and subscribers.
+func ClientMetrics(m *Metrics) ClientOption {
+	return func(c *Client) { c.metrics = m }
+}
+
+// SubscriberMetrics sets collectors for deliveries of the queue.
+// Client sets it for every subscription if ClientMetrics is used.
+func SubscriberMetrics(m *Metrics, queue string) SubscriberOption {
+	return func(s *Subscriber) {
+		s.metrics = m
+		s.queue = queue
+	}
+}
+
+// All methods are safe to call on nil Metrics.
+
+func (m *Metrics) publish(exchange, key string, err error, begin time.Time) {
+	if m == nil {
+		return
+	}
+
+	labels := []string{"exchange", exchange, "key", key, "error", fmt.Sprint(err != nil)}
+	m.publishCount.With(labels...).Add(1)
+	m.publishLatency.With(labels...).Observe(time.Since(begin).Seconds())
+}
+
+func (m *Metrics) delivery(queue, outcome string, begin time.Time) {
+	if m == nil {
+		return
+	}
+
+	m.deliveryCount.With("queue", queue, "outcome", outcome).Add(1)
+	m.deliveryLatency.With("queue", queue).Observe(time.Since(begin).Seconds())
+}
+
+func (m *Metrics) poolSize(size int) {
+	if m == nil {
+		return
+	}
+	m.channelPoolSize.Set(float64(size))
+}
+
+func (m *Metrics) poolMiss() {
+	if m == nil {
+		return
+	}
+	m.channelPoolMisses.Add(1)
+}
+
+func (m *Metrics) reconnect() {
+	if m == nil {
+		return
+	}
+	m.reconnectCount.Add(1)
+}
+
+func (m *Metrics) consumers(queue string, delta float64) {
+	if m == nil {
+		return
+	}
+	m.consumerCount.With("queue", queue).Add(delta)
+}
+
+func (m *Metrics) bufferDepth(depth int) {
+	if m == nil {
+		return
+	}
+	m.bufferSize.Set(float64(depth))
+}
+
+func (m *Metrics) bufferDrop() {
+	if m == nil {
+		return
+	}
+	m.bufferDrops.Add(1)
+}
+
+func (m *Metrics) queue(queue string, messages, consumers int) {
+	if m == nil {
+		return
+	}
+	m.queueMessages.With("queue", queue).Set(float64(messages))
+	m.queueConsumers.With("queue", queue).Set(float64(consumers))
+}
+
+// outcomeAcknowledger records how a delivery was settled
+type outcomeAcknowledger struct {
+	amqp.Acknowledger
+	outcome string
+}
+
+func (a *outcomeAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.outcome = OutcomeAck
+	return a.Acknowledger.Ack(tag, multiple)
+}
+
+func (a *outcomeAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.outcome = OutcomeNack
+	return a.Acknowledger.Nack(tag, multiple, requeue)
+}
+
+func (a *outcomeAcknowledger) Reject(tag uint64, requeue bool) error {
+	a.outcome = OutcomeReject
+	return a.Acknowledger.Reject(tag, requeue)
+}
@@ -0,0 +1,72 @@
+package amqp_kit
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscriberMetrics(t *testing.T) {
+	m := NewMetrics()
+	assert.True(t, m == NewMetrics())
+
+	dec := func(ctx context.Context, d *amqp.Delivery) (interface{}, error) {
+		return string(d.Body), nil
+	}
+	e := func(ctx context.Context, request interface{}) (interface{}, error) {
+		if request.(string) == "fail" {
+			return nil, errors.New("fail")
+		}
+		return nil, nil
+	}
+
+	fun := NewSubscriber(e, dec, EncodeNopResponse,
+		SubscriberMetrics(m, `metrics_q`),
+		SubscriberAfter(SetAckAfterEndpoint(false)),
+		SubscriberErrorEncoder(func(ctx context.Context, err error, d *amqp.Delivery, ch Channel, pub *amqp.Publishing) {
+			d.Nack(false, false)
+		}),
+	).ServeDelivery(&fakeChannel{})
+
+	fun(&amqp.Delivery{Acknowledger: &fakeAcknowledger{}, Body: []byte(`ok`)})
+	fun(&amqp.Delivery{Acknowledger: &fakeAcknowledger{}, Body: []byte(`fail`)})
+
+	m.publish(`metrics_exc`, `metrics.key`, nil, time.Now())
+	m.poolMiss()
+	m.consumers(`metrics_q`, 1)
+	m.bufferDepth(3)
+
+	req, err := http.NewRequest("", "", nil)
+	require.NoError(t, err)
+	rec := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(rec, req)
+	body, err := ioutil.ReadAll(rec.Body)
+	require.NoError(t, err)
+
+	assert.Contains(t, string(body), `amqp_delivery_count{outcome="ack",queue="metrics_q"} 1`)
+	assert.Contains(t, string(body), `amqp_delivery_count{outcome="nack",queue="metrics_q"} 1`)
+	assert.Contains(t, string(body), `amqp_delivery_latency_seconds_count{queue="metrics_q"} 2`)
+	assert.Contains(t, string(body), `amqp_publish_count{error="false",exchange="metrics_exc",key="metrics.key"} 1`)
+	assert.Contains(t, string(body), `amqp_channel_pool_misses 1`)
+	assert.Contains(t, string(body), `amqp_consumer_count{queue="metrics_q"} 1`)
+	assert.Contains(t, string(body), `amqp_outbound_buffer_size 3`)
+}
+
+func TestNilMetrics(t *testing.T) {
+	var m *Metrics
+	m.publish(`exc`, `key`, nil, time.Now())
+	m.delivery(`q`, OutcomeAck, time.Now())
+	m.poolSize(1)
+	m.poolMiss()
+	m.reconnect()
+	m.consumers(`q`, 1)
+}
@@ -0,0 +1,57 @@
+package amqp_kit
+
+import "math/rand"
+
+// NodeSelection is a strategy of choosing a cluster node to connect
+type NodeSelection int
+
+const (
+	// NodePreferFirst tries nodes in the given order, starting with the first one.
+	NodePreferFirst NodeSelection = iota
+	// NodeRoundRobin tries nodes in the given order, starting with the node after the last connected one.
+	NodeRoundRobin
+	// NodeRandom tries nodes in random order.
+	NodeRandom
+)
+
+func (c *Config) nodes() []string {
+	if len(c.Addresses) == 0 {
+		return []string{c.Address}
+	}
+	return c.Addresses
+}
+
+// nodeOrder returns indexes of nodes in order of connection attempts
+func (c *Client) nodeOrder() []int {
+	n := len(c.config.nodes())
+
+	switch c.config.NodeSelection {
+	case NodeRandom:
+		return rand.Perm(n)
+	case NodeRoundRobin:
+		order := make([]int, n)
+		start := c.nodeIdx + 1
+		if c.conn == nil {
+			start = 0
+		}
+		for i := range order {
+			order[i] = (start + i) % n
+		}
+		return order
+	default:
+		order := make([]int, n)
+		for i := range order {
+			order[i] = i
+		}
+		return order
+	}
+}
+
+// Node returns the address of the connected node
+func (c *Client) Node() string {
+	conn := c.getConnection()
+	if conn == nil {
+		return ""
+	}
+	return conn.addr
+}
@@ -0,0 +1,48 @@
+package amqp_kit
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNodeOrder(t *testing.T) {
+	cfg := &Config{Addresses: []string{"a:5672", "b:5672", "c:5672"}}
+	cl := &Client{config: cfg}
+
+	assert.Equal(t, []int{0, 1, 2}, cl.nodeOrder())
+
+	cfg.NodeSelection = NodeRoundRobin
+	assert.Equal(t, []int{0, 1, 2}, cl.nodeOrder())
+
+	cl.conn = &connection{}
+	cl.nodeIdx = 1
+	assert.Equal(t, []int{2, 0, 1}, cl.nodeOrder())
+
+	cfg.NodeSelection = NodeRandom
+	order := cl.nodeOrder()
+	sort.Ints(order)
+	assert.Equal(t, []int{0, 1, 2}, order)
+}
+
+func TestConfigNodes(t *testing.T) {
+	cfg := &Config{Address: "a:5672"}
+	assert.Equal(t, []string{"a:5672"}, cfg.nodes())
+	assert.Equal(t, "amqp://:@a:5672/", MakeDsn(cfg))
+
+	cfg.Addresses = []string{"b:5672", "c:5672"}
+	assert.Equal(t, []string{"b:5672", "c:5672"}, cfg.nodes())
+	assert.Equal(t, "amqp://:@b:5672/", MakeDsn(cfg))
+}
+
+func (s *apiSuite) TestFailover() {
+	cl, err := New(&Config{
+		Addresses: []string{"127.0.0.1:1", rabbitTestAddr},
+		User:      "guest",
+		Password:  "guest",
+	})
+	s.Require().NoError(err)
+	s.Equal(rabbitTestAddr, cl.Node())
+	s.Require().NoError(cl.Close())
+}
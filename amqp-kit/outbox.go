@@ -0,0 +1,370 @@
+package amqp_kit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/space307/go-utils/v3/database"
+	"github.com/space307/go-utils/v3/sg"
+	"github.com/streadway/amqp"
+)
+
+const (
+	defaultOutboxPollInterval    = time.Second
+	defaultOutboxBatchSize       = 100
+	defaultOutboxRetention       = 24 * time.Hour
+	defaultOutboxCleanupInterval = time.Minute
+
+	outboxColumns = `t.id, t.aggregate_key, t.exchange, t.routing_key, t.content_type, t.correlation_id, t.message_id, t.headers, t.body`
+)
+
+var (
+	// OutboxRelay must satisfy the sg.Server interface.
+	_ sg.Server = (*OutboxRelay)(nil)
+)
+
+// OutboxMessage is a message written to the outbox in a transaction
+type OutboxMessage struct {
+	// AggregateKey orders messages: messages with the same key are published in order of Enqueue,
+	// messages with an empty key are published in any order
+	AggregateKey  string
+	ContentType   string
+	CorrelationID string
+	// MessageID may be used by SubscriberDedup, the relay publishes a message at least once
+	MessageID string
+	// Headers are stored as JSON, so numbers are published as float64
+	Headers amqp.Table
+	Body    []byte
+}
+
+// Outbox writes messages to a MySQL or Postgres table in the transaction of the caller,
+// OutboxRelay publishes them with publisher confirms after commit:
+//
+//	CREATE TABLE amqp_outbox (
+//		id             BIGINT AUTO_INCREMENT PRIMARY KEY, -- BIGSERIAL for Postgres
+//		aggregate_key  VARCHAR(255) NOT NULL,
+//		exchange       VARCHAR(255) NOT NULL,
+//		routing_key    VARCHAR(255) NOT NULL,
+//		content_type   VARCHAR(255) NOT NULL,
+//		correlation_id VARCHAR(255) NOT NULL,
+//		message_id     VARCHAR(255) NOT NULL,
+//		headers        TEXT NOT NULL,
+//		body           BLOB, -- BYTEA for Postgres
+//		created_at     BIGINT NOT NULL,
+//		sent_at        BIGINT
+//	);
+//	CREATE INDEX amqp_outbox_aggregate ON amqp_outbox (aggregate_key, sent_at);
+//
+// The relay locks rows with FOR UPDATE SKIP LOCKED, so MySQL 8.0 or Postgres 9.5 is required.
+type Outbox struct {
+	db           *database.Database
+	table        string
+	insertQuery  string
+	selectQuery  string
+	sentQuery    string
+	cleanupQuery string
+}
+
+// NewOutbox creates an outbox in the table
+func NewOutbox(db *database.Database, table string) *Outbox {
+	p := func(n int) string { return placeholder(db.GetDriver(), n) }
+
+	return &Outbox{
+		db:    db,
+		table: table,
+		insertQuery: fmt.Sprintf(`INSERT INTO %s (aggregate_key, exchange, routing_key, content_type, correlation_id, message_id, headers, body, created_at) `+
+			`VALUES (%s)`, table, strings.Join(placeholderList(db.GetDriver(), 9), ", ")),
+		// only the oldest unsent message of an aggregate is claimed, so relays do not reorder it
+		selectQuery: fmt.Sprintf(`SELECT `+outboxColumns+` FROM %[1]s t WHERE t.sent_at IS NULL AND (t.aggregate_key = '' OR NOT EXISTS `+
+			`(SELECT 1 FROM %[1]s o WHERE o.aggregate_key = t.aggregate_key AND o.sent_at IS NULL AND o.id < t.id)) `+
+			`ORDER BY t.id LIMIT %[2]s FOR UPDATE SKIP LOCKED`, table, p(1)),
+		sentQuery:    fmt.Sprintf(`UPDATE %s SET sent_at = %s WHERE id = %s`, table, p(1), p(2)),
+		cleanupQuery: fmt.Sprintf(`DELETE FROM %s WHERE sent_at IS NOT NULL AND sent_at <= %s`, table, p(1)),
+	}
+}
+
+// Enqueue writes the message in the transaction, it is published only if the transaction is committed
+func (o *Outbox) Enqueue(tx *database.TxConnection, exchange, key string, msg *OutboxMessage) error {
+	headers, err := json.Marshal(msg.Headers)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Tx.Exec(o.insertQuery, msg.AggregateKey, exchange, key, msg.ContentType, msg.CorrelationID, msg.MessageID,
+		string(headers), msg.Body, time.Now().Unix())
+	return err
+}
+
+// followQuery returns a query locking unsent messages of the claimed aggregates
+func (o *Outbox) followQuery(aggregates int) string {
+	driver := o.db.GetDriver()
+	list := placeholderList(driver, aggregates)
+
+	return fmt.Sprintf(`SELECT `+outboxColumns+` FROM %s t WHERE t.sent_at IS NULL AND t.aggregate_key IN (%s) `+
+		`ORDER BY t.id LIMIT %s FOR UPDATE`, o.table, strings.Join(list, ", "), placeholder(driver, aggregates+1))
+}
+
+// Relay creates a relay publishing messages of the outbox by the client.
+// The client must publish with PublishConfirm and without OutboundBuffer,
+// so a message is marked sent only after the broker has confirmed it.
+func (o *Outbox) Relay(c *Client, opts ...OutboxRelayOption) (*OutboxRelay, error) {
+	if !c.config.PublishConfirm || c.config.OutboundBuffer > 0 {
+		return nil, ErrOutboxUnconfirmed
+	}
+
+	return o.relay(c, opts...), nil
+}
+
+func (o *Outbox) relay(pub Publisher, opts ...OutboxRelayOption) *OutboxRelay {
+	r := &OutboxRelay{
+		outbox:          o,
+		pub:             pub,
+		pollInterval:    defaultOutboxPollInterval,
+		batchSize:       defaultOutboxBatchSize,
+		retention:       defaultOutboxRetention,
+		cleanupInterval: defaultOutboxCleanupInterval,
+		stop:            make(chan struct{}),
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	return r
+}
+
+// OutboxRelayOption sets an optional parameter for outbox relays.
+type OutboxRelayOption func(*OutboxRelay)
+
+// OutboxPollInterval sets the interval of polling the outbox when there are no messages to publish
+func OutboxPollInterval(d time.Duration) OutboxRelayOption {
+	return func(r *OutboxRelay) { r.pollInterval = d }
+}
+
+// OutboxBatchSize sets the maximum number of messages published in one transaction,
+// consecutive messages of an aggregate are published in one batch
+func OutboxBatchSize(n int) OutboxRelayOption {
+	return func(r *OutboxRelay) { r.batchSize = n }
+}
+
+// OutboxRetention sets how long sent messages are kept in the outbox
+func OutboxRetention(d time.Duration) OutboxRelayOption {
+	return func(r *OutboxRelay) { r.retention = d }
+}
+
+// OutboxCleanupInterval sets the interval of deleting sent messages older than the retention
+func OutboxCleanupInterval(d time.Duration) OutboxRelayOption {
+	return func(r *OutboxRelay) { r.cleanupInterval = d }
+}
+
+// OutboxRelay publishes messages of the outbox and marks them sent.
+// Several relays may serve one outbox.
+type OutboxRelay struct {
+	outbox          *Outbox
+	pub             Publisher
+	pollInterval    time.Duration
+	batchSize       int
+	retention       time.Duration
+	cleanupInterval time.Duration
+	ctx             context.Context
+	cancel          context.CancelFunc
+	stop            chan struct{}
+	stopOnce        sync.Once
+}
+
+// outboxRow is a message read from the outbox
+type outboxRow struct {
+	id       int64
+	exchange string
+	key      string
+	msg      OutboxMessage
+}
+
+// Serve publishes messages of the outbox until Stop is called
+func (r *OutboxRelay) Serve() error {
+	cleanup := time.NewTicker(r.cleanupInterval)
+	defer cleanup.Stop()
+
+	for {
+		select {
+		case <-cleanup.C:
+			if n, err := r.Cleanup(); err != nil {
+				log.Warnf("AMQP: outbox cleanup err %v", err)
+			} else if n > 0 {
+				log.Debugf("AMQP: outbox cleanup deleted %d messages", n)
+			}
+		default:
+		}
+
+		sent, err := r.Relay()
+		if err != nil {
+			log.Warnf("AMQP: outbox relay err %v", err)
+		}
+
+		// more messages may be waiting
+		if sent > 0 && err == nil {
+			select {
+			case <-r.stop:
+				return nil
+			default:
+				continue
+			}
+		}
+
+		select {
+		case <-r.stop:
+			return nil
+		case <-time.After(r.pollInterval):
+		}
+	}
+}
+
+// Stop stops the relay, the transaction in progress is committed with messages published so far
+func (r *OutboxRelay) Stop() error {
+	r.stopOnce.Do(func() {
+		close(r.stop)
+		r.cancel()
+	})
+
+	return nil
+}
+
+// Relay publishes one batch of messages and returns the number of sent messages.
+// Messages failed to publish and following messages of their aggregates are retried by the next call.
+func (r *OutboxRelay) Relay() (int, error) {
+	tx, err := r.outbox.db.StartTransaction()
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := r.lock(tx)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	sent := 0
+	failed := make(map[string]bool)
+	for _, row := range rows {
+		aggregate := row.msg.AggregateKey
+		if failed[aggregate] {
+			continue
+		}
+		if err = r.publish(row); err != nil {
+			log.Warnf("AMQP: outbox message %d to exchange %s key %s is not published, err %v", row.id, row.exchange, row.key, err)
+			if aggregate != "" {
+				failed[aggregate] = true
+			}
+			continue
+		}
+
+		if _, err = tx.Tx.Exec(r.outbox.sentQuery, time.Now().Unix(), row.id); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		sent++
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return sent, nil
+}
+
+// Cleanup deletes sent messages older than the retention and returns their number
+func (r *OutboxRelay) Cleanup() (int64, error) {
+	res, err := r.outbox.db.Exec(r.outbox.cleanupQuery, time.Now().Add(-r.retention).Unix())
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// lock claims the oldest unsent messages of aggregates and then following messages
+// of the claimed aggregates up to the batch size, they are returned in order of Enqueue.
+// Other relays skip the claimed aggregates while their oldest messages are locked.
+func (r *OutboxRelay) lock(tx *database.TxConnection) ([]outboxRow, error) {
+	list, err := r.query(tx, r.outbox.selectQuery, r.batchSize)
+	if err != nil || len(list) >= r.batchSize {
+		return list, err
+	}
+
+	claimed := make(map[int64]bool, len(list))
+	var args []interface{}
+	seen := make(map[string]bool)
+	for _, row := range list {
+		claimed[row.id] = true
+		if key := row.msg.AggregateKey; key != "" && !seen[key] {
+			seen[key] = true
+			args = append(args, key)
+		}
+	}
+	if len(args) == 0 {
+		return list, nil
+	}
+
+	following, err := r.query(tx, r.outbox.followQuery(len(args)), append(args, r.batchSize)...)
+	if err != nil {
+		return nil, err
+	}
+	// following messages are in order of Enqueue, so a prefix of every aggregate is taken
+	for _, row := range following {
+		if len(list) >= r.batchSize {
+			break
+		}
+		if !claimed[row.id] {
+			list = append(list, row)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].id < list[j].id })
+
+	return list, nil
+}
+
+func (r *OutboxRelay) query(tx *database.TxConnection, query string, args ...interface{}) ([]outboxRow, error) {
+	rows, err := tx.Tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []outboxRow
+	for rows.Next() {
+		var (
+			row     outboxRow
+			headers string
+		)
+		err = rows.Scan(&row.id, &row.msg.AggregateKey, &row.exchange, &row.key, &row.msg.ContentType,
+			&row.msg.CorrelationID, &row.msg.MessageID, &headers, &row.msg.Body)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(headers), &row.msg.Headers); err != nil {
+			return nil, err
+		}
+		list = append(list, row)
+	}
+
+	return list, rows.Err()
+}
+
+func (r *OutboxRelay) publish(row outboxRow) error {
+	opts := []PublishOption{
+		PublishCorrelationID(row.msg.CorrelationID),
+		PublishMessageID(row.msg.MessageID),
+		PublishHeaders(row.msg.Headers),
+	}
+	if row.msg.ContentType != "" {
+		opts = append(opts, PublishContentType(row.msg.ContentType, ""))
+	}
+
+	return r.pub.PublishWithOptions(r.ctx, row.exchange, row.key, row.msg.Body, opts...)
+}
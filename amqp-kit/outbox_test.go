@@ -0,0 +1,151 @@
+package amqp_kit
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/space307/go-utils/v3/database"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakePublisher struct {
+	lock      sync.Mutex
+	err       error
+	failKey   string
+	published []amqp.Publishing
+	keys      []string
+}
+
+func (p *fakePublisher) Publish(exchange, key, corID string, body []byte) error {
+	return p.PublishWithOptions(context.Background(), exchange, key, body, PublishCorrelationID(corID))
+}
+
+func (p *fakePublisher) PublishWithTracing(ctx context.Context, exchange, key, corID string, body []byte) error {
+	return p.PublishWithOptions(ctx, exchange, key, body, PublishCorrelationID(corID))
+}
+
+func (p *fakePublisher) PublishWithOptions(_ context.Context, exchange, key string, body []byte, opts ...PublishOption) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.err != nil {
+		return p.err
+	}
+	if key == p.failKey {
+		return errors.New("publish error")
+	}
+	p.published = append(p.published, newPublishing(body, opts...))
+	p.keys = append(p.keys, key)
+	return nil
+}
+
+func TestOutboxRelayPublish(t *testing.T) {
+	p := &fakePublisher{}
+	r := (&Outbox{}).relay(p)
+
+	require.NoError(t, r.publish(outboxRow{
+		exchange: `exc`,
+		key:      `order.created`,
+		msg: OutboxMessage{
+			ContentType:   `application/x-protobuf`,
+			CorrelationID: `cor`,
+			MessageID:     `msg`,
+			Headers:       amqp.Table{"tenant": "1"},
+			Body:          []byte(`body`),
+		},
+	}))
+
+	require.Len(t, p.published, 1)
+	pub := p.published[0]
+	assert.Equal(t, `application/x-protobuf`, pub.ContentType)
+	assert.Equal(t, `cor`, pub.CorrelationId)
+	assert.Equal(t, `msg`, pub.MessageId)
+	assert.Equal(t, amqp.Table{"tenant": "1"}, pub.Headers)
+	assert.Equal(t, amqp.Persistent, pub.DeliveryMode)
+	assert.Equal(t, []string{`order.created`}, p.keys)
+}
+
+func TestOutboxRelayConfirm(t *testing.T) {
+	o := &Outbox{}
+
+	_, err := o.Relay(&Client{config: &Config{}})
+	assert.Equal(t, ErrOutboxUnconfirmed, err)
+
+	_, err = o.Relay(&Client{config: &Config{PublishConfirm: true, OutboundBuffer: 10}})
+	assert.Equal(t, ErrOutboxUnconfirmed, err)
+
+	r, err := o.Relay(&Client{config: &Config{PublishConfirm: true}})
+	require.NoError(t, err)
+	assert.NotNil(t, r)
+}
+
+func TestOutbox(t *testing.T) {
+	db, err := database.InitDatabase(&database.Config{
+		Addr:     "127.0.0.1:3306",
+		User:     "travis",
+		Database: "db_test",
+	})
+	require.NoError(t, err)
+
+	// FOR UPDATE SKIP LOCKED is supported since MySQL 8.0
+	var version string
+	row, err := db.QueryRow("SELECT VERSION()")
+	require.NoError(t, err)
+	require.NoError(t, row.Scan(&version))
+	require.NoError(t, row.Close())
+	if strings.HasPrefix(version, "5.") {
+		t.Skipf("MySQL %s does not support SKIP LOCKED", version)
+	}
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS amqp_outbox (id BIGINT AUTO_INCREMENT PRIMARY KEY, " +
+		"aggregate_key VARCHAR(255) NOT NULL, exchange VARCHAR(255) NOT NULL, routing_key VARCHAR(255) NOT NULL, " +
+		"content_type VARCHAR(255) NOT NULL, correlation_id VARCHAR(255) NOT NULL, message_id VARCHAR(255) NOT NULL, " +
+		"headers TEXT NOT NULL, body BLOB, created_at BIGINT NOT NULL, sent_at BIGINT)")
+	require.NoError(t, err)
+	_, err = db.Exec("DELETE FROM amqp_outbox")
+	require.NoError(t, err)
+
+	o := NewOutbox(db, "amqp_outbox")
+
+	tx, err := db.StartTransaction()
+	require.NoError(t, err)
+	require.NoError(t, o.Enqueue(tx, `exc`, `rolled.back`, &OutboxMessage{Body: []byte(`0`)}))
+	require.NoError(t, tx.Rollback())
+
+	tx, err = db.StartTransaction()
+	require.NoError(t, err)
+	for _, key := range []string{`a.1`, `a.2`, `b.1`, `a.3`, `b.2`, `b.3`} {
+		require.NoError(t, o.Enqueue(tx, `exc`, key, &OutboxMessage{AggregateKey: key[:1], Body: []byte(key)}))
+	}
+	require.NoError(t, tx.Commit())
+
+	p := &fakePublisher{err: errors.New("connection closed")}
+	r := o.relay(p, OutboxRetention(0), OutboxBatchSize(4))
+
+	sent, err := r.Relay()
+	require.NoError(t, err)
+	assert.Equal(t, 0, sent)
+
+	// consecutive messages of claimed aggregates are published in one batch,
+	// messages following a failed one wait for the next batch
+	p.err = nil
+	p.failKey = `a.2`
+	sent, err = r.Relay()
+	require.NoError(t, err)
+	assert.Equal(t, 2, sent)
+	assert.Equal(t, []string{`a.1`, `b.1`}, p.keys)
+
+	p.failKey = ``
+	sent, err = r.Relay()
+	require.NoError(t, err)
+	assert.Equal(t, 4, sent)
+	assert.Equal(t, []string{`a.1`, `b.1`, `a.2`, `a.3`, `b.2`, `b.3`}, p.keys)
+
+	deleted, err := r.Cleanup()
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), deleted)
+}
@@ -0,0 +1,110 @@
+package amqp_kit
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// PublishOption sets a property of a published message
+type PublishOption func(*amqp.Publishing)
+
+// PublishHeader sets the header of the message
+func PublishHeader(key string, value interface{}) PublishOption {
+	return func(p *amqp.Publishing) { p.Headers[key] = value }
+}
+
+// PublishHeaders sets the headers of the message, other headers are kept
+func PublishHeaders(headers amqp.Table) PublishOption {
+	return func(p *amqp.Publishing) {
+		for k, v := range headers {
+			p.Headers[k] = v
+		}
+	}
+}
+
+// PublishCorrelationID sets the correlation ID of the message
+func PublishCorrelationID(corID string) PublishOption {
+	return func(p *amqp.Publishing) { p.CorrelationId = corID }
+}
+
+// PublishMessageID sets the message ID
+func PublishMessageID(id string) PublishOption {
+	return func(p *amqp.Publishing) { p.MessageId = id }
+}
+
+// PublishTimestamp sets the message timestamp
+func PublishTimestamp(t time.Time) PublishOption {
+	return func(p *amqp.Publishing) { p.Timestamp = t }
+}
+
+// PublishType sets the message type name
+func PublishType(typ string) PublishOption {
+	return func(p *amqp.Publishing) { p.Type = typ }
+}
+
+// PublishPriority sets the message priority, 0 to 9
+func PublishPriority(priority uint8) PublishOption {
+	return func(p *amqp.Publishing) { p.Priority = priority }
+}
+
+// PublishExpiration sets the message TTL, rounded down to milliseconds
+func PublishExpiration(ttl time.Duration) PublishOption {
+	return func(p *amqp.Publishing) { p.Expiration = strconv.FormatInt(int64(ttl/time.Millisecond), 10) }
+}
+
+// PublishReplyTo sets the queue name for replies
+func PublishReplyTo(replyTo string) PublishOption {
+	return func(p *amqp.Publishing) { p.ReplyTo = replyTo }
+}
+
+// PublishAppID sets the ID of the publishing application
+func PublishAppID(appID string) PublishOption {
+	return func(p *amqp.Publishing) { p.AppId = appID }
+}
+
+// PublishDeliveryMode sets amqp.Persistent (default) or amqp.Transient delivery mode
+func PublishDeliveryMode(mode uint8) PublishOption {
+	return func(p *amqp.Publishing) { p.DeliveryMode = mode }
+}
+
+// PublishContentType sets the content type and encoding of the body, see RegisterCodec
+func PublishContentType(contentType, contentEncoding string) PublishOption {
+	return func(p *amqp.Publishing) {
+		p.ContentType = contentType
+		p.ContentEncoding = contentEncoding
+	}
+}
+
+// PublishWithOptions publishing the message to given exchange with key.
+// The message is persistent JSON by default. The span from ctx is injected into headers.
+func (c *Client) PublishWithOptions(ctx context.Context, exchange, key string, body []byte, opts ...PublishOption) error {
+	pub := newPublishing(body, opts...)
+
+	span := startPublishSpan(ctx, exchange, key, &pub)
+	defer span.Finish()
+
+	err := c.send(ctx, exchange, key, &pub)
+	if err != nil {
+		span.SetTag(tagError, err.Error())
+	}
+
+	return err
+}
+
+func newPublishing(body []byte, opts ...PublishOption) amqp.Publishing {
+	pub := amqp.Publishing{
+		Headers:      amqp.Table{},
+		ContentType:  ContentTypeJSON,
+		Body:         body,
+		DeliveryMode: amqp.Persistent,
+	}
+
+	for _, opt := range opts {
+		opt(&pub)
+	}
+
+	return pub
+}
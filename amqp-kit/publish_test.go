@@ -0,0 +1,46 @@
+package amqp_kit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewPublishing(t *testing.T) {
+	pub := newPublishing([]byte(`{}`))
+	assert.Equal(t, ContentTypeJSON, pub.ContentType)
+	assert.Equal(t, amqp.Persistent, pub.DeliveryMode)
+	assert.Empty(t, pub.Headers)
+
+	ts := time.Unix(1000, 0)
+	pub = newPublishing([]byte(`body`),
+		PublishHeaders(amqp.Table{"a": "1", "b": "2"}),
+		PublishHeader("b", "3"),
+		PublishCorrelationID("cor"),
+		PublishMessageID("msg"),
+		PublishTimestamp(ts),
+		PublishType("type"),
+		PublishPriority(5),
+		PublishExpiration(1500*time.Millisecond),
+		PublishReplyTo("reply"),
+		PublishAppID("app"),
+		PublishDeliveryMode(amqp.Transient),
+		PublishContentType("application/x-msgpack", ContentEncodingGzip),
+	)
+
+	assert.Equal(t, amqp.Table{"a": "1", "b": "3"}, pub.Headers)
+	assert.Equal(t, "cor", pub.CorrelationId)
+	assert.Equal(t, "msg", pub.MessageId)
+	assert.Equal(t, ts, pub.Timestamp)
+	assert.Equal(t, "type", pub.Type)
+	assert.Equal(t, uint8(5), pub.Priority)
+	assert.Equal(t, "1500", pub.Expiration)
+	assert.Equal(t, "reply", pub.ReplyTo)
+	assert.Equal(t, "app", pub.AppId)
+	assert.Equal(t, amqp.Transient, pub.DeliveryMode)
+	assert.Equal(t, "application/x-msgpack", pub.ContentType)
+	assert.Equal(t, ContentEncodingGzip, pub.ContentEncoding)
+	assert.Equal(t, []byte(`body`), pub.Body)
+}
@@ -0,0 +1,199 @@
+package amqp_kit
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+const (
+	// RetryAttemptsHeader holds the number of failed attempts to process a delivery
+	RetryAttemptsHeader = "x-retry-attempts"
+	// LastErrorHeader holds the last processing error of a parked delivery
+	LastErrorHeader = "x-last-error"
+
+	originalExchangeHeader   = "x-original-exchange"
+	originalRoutingKeyHeader = "x-original-routing-key"
+
+	defaultRetryMaxAttempts = 3
+	defaultRetryDelay       = time.Second
+	defaultRetryMultiplier  = 2
+)
+
+// RetryPolicy describes redelivery of failed messages through delay queues.
+// A failed delivery is republished to the delay queue "<queue>.retry.<attempt>", which
+// dead-letters it back to the queue after the delay expires. A delivery failed
+// MaxAttempts times is published to the "<queue>.parking" queue with the last error
+// in the LastErrorHeader. The delivery is acked after it is republished.
+// Delay grows by Multiplier each attempt and is limited by MaxDelay if set.
+// Queue is the consumed queue name, Client sets it from SubscribeInfo.
+type RetryPolicy struct {
+	Queue       string
+	MaxAttempts int
+	Delay       time.Duration
+	MaxDelay    time.Duration
+	Multiplier  float64
+}
+
+// SubscriberRetry sets a retry policy for failed deliveries. The delivery is acked
+// after it is republished to a delay queue or to the parking queue. The ErrorEncoder
+// is called when the error is not retryable by ClassifyError or when the delivery
+// is parked, a parked delivery is settled already, so the encoder may only reply.
+func SubscriberRetry(p RetryPolicy) SubscriberOption {
+	return func(s *Subscriber) {
+		// every subscriber resolves the queue in its own copy
+		policy := p
+		s.retry = &policy
+	}
+}
+
+func (p *RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts == 0 {
+		return defaultRetryMaxAttempts
+	}
+	return p.MaxAttempts
+}
+
+// delay returns the delay before the given attempt, attempts start with 1
+func (p *RetryPolicy) delay(attempt int) time.Duration {
+	delay, multiplier := p.Delay, p.Multiplier
+	if delay == 0 {
+		delay = defaultRetryDelay
+	}
+	if multiplier == 0 {
+		multiplier = defaultRetryMultiplier
+	}
+
+	d := time.Duration(float64(delay) * math.Pow(multiplier, float64(attempt-1)))
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return d
+}
+
+func (p *RetryPolicy) delayQueue(attempt int) string {
+	return p.Queue + ".retry." + strconv.Itoa(attempt)
+}
+
+func (p *RetryPolicy) parkingQueue() string {
+	return p.Queue + ".parking"
+}
+
+// DeclareRetryQueues create delay queues and parking queue of the policy
+func DeclareRetryQueues(ch AMQPChannel, p *RetryPolicy) error {
+	for attempt := 1; attempt < p.maxAttempts(); attempt++ {
+		qi := &QueueInfo{
+			MessageTTL:    p.delay(attempt),
+			DeadLetterKey: p.Queue,
+			// dead-letter through the default exchange straight to the queue
+			Args: amqp.Table{"x-dead-letter-exchange": ""},
+		}
+		if err := DeclareQueue(ch, p.delayQueue(attempt), qi); err != nil {
+			return err
+		}
+	}
+
+	return DeclareQueue(ch, p.parkingQueue(), nil)
+}
+
+// retry republishes the failed delivery to a delay queue or to the parking queue and acks it.
+// It returns true if attempts are exhausted and the delivery is parked.
+func (p *RetryPolicy) retry(err error, d *amqp.Delivery, ch Channel) bool {
+	attempt := retryAttempts(d) + 1
+
+	pub := amqp.Publishing{
+		Headers:         amqp.Table{},
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    d.DeliveryMode,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		UserId:          d.UserId,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	}
+	for k, v := range d.Headers {
+		pub.Headers[k] = v
+	}
+	pub.Headers[RetryAttemptsHeader] = int32(attempt)
+	pub.Headers[originalExchangeHeader] = d.Exchange
+	pub.Headers[originalRoutingKeyHeader] = d.RoutingKey
+
+	key := p.delayQueue(attempt)
+	if attempt >= p.maxAttempts() {
+		key = p.parkingQueue()
+		pub.Headers[LastErrorHeader] = err.Error()
+	}
+
+	if pubErr := ch.Publish("", key, false, false, pub); pubErr != nil {
+		log.Errorf(`AMQP: retry publish to %s err: %s`, key, pubErr)
+		_ = d.Nack(false, true)
+		return false
+	}
+
+	_ = d.Ack(false)
+	return attempt >= p.maxAttempts()
+}
+
+// settledAcknowledger ignores settling of a delivery acked already
+type settledAcknowledger struct{}
+
+func (settledAcknowledger) Ack(tag uint64, multiple bool) error {
+	return nil
+}
+
+func (settledAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	return nil
+}
+
+func (settledAcknowledger) Reject(tag uint64, requeue bool) error {
+	return nil
+}
+
+func retryAttempts(d *amqp.Delivery) int {
+	switch v := d.Headers[RetryAttemptsHeader].(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	}
+	return 0
+}
+
+// restoreRouting sets exchange and routing key of a delivery returned from a delay queue
+func restoreRouting(d *amqp.Delivery) {
+	if exchange, ok := d.Headers[originalExchangeHeader].(string); ok {
+		d.Exchange = exchange
+	}
+	if key, ok := d.Headers[originalRoutingKeyHeader].(string); ok {
+		d.RoutingKey = key
+	}
+}
+
+func (s Subscriber) handleError(ctx context.Context, err error, d *amqp.Delivery, ch Channel, pub *amqp.Publishing) {
+	// permanent and poison errors are not retried
+	if s.retry != nil && ClassifyError(err) == ErrorRetryable {
+		if s.retry.Queue == "" {
+			log.Errorf(`AMQP: retry policy without queue, err: %s`, err)
+		} else if !s.retry.retry(err, d, ch) {
+			return
+		} else {
+			// the parked delivery is acked, the encoder only replies
+			parked := *d
+			parked.Acknowledger = settledAcknowledger{}
+			d = &parked
+		}
+	}
+
+	s.errorEncoder(ctx, err, d, ch, pub)
+}
@@ -0,0 +1,193 @@
+package amqp_kit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type publishedMessage struct {
+	exchange, key string
+	msg           amqp.Publishing
+}
+
+type fakeChannel struct {
+	published []publishedMessage
+	err       error
+}
+
+func (c *fakeChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	c.published = append(c.published, publishedMessage{exchange: exchange, key: key, msg: msg})
+	return c.err
+}
+
+func (c *fakeChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWail bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	return nil, nil
+}
+
+type fakeAcknowledger struct {
+	acks, nacks, rejects int
+	requeue              bool
+}
+
+func (a *fakeAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.acks++
+	return nil
+}
+
+func (a *fakeAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.nacks++
+	a.requeue = requeue
+	return nil
+}
+
+func (a *fakeAcknowledger) Reject(tag uint64, requeue bool) error {
+	a.rejects++
+	a.requeue = requeue
+	return nil
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := &RetryPolicy{Delay: time.Second, MaxDelay: 5 * time.Second}
+
+	assert.Equal(t, time.Second, p.delay(1))
+	assert.Equal(t, 2*time.Second, p.delay(2))
+	assert.Equal(t, 4*time.Second, p.delay(3))
+	assert.Equal(t, 5*time.Second, p.delay(4))
+
+	p = &RetryPolicy{Delay: time.Second, Multiplier: 3}
+	assert.Equal(t, 9*time.Second, p.delay(3))
+}
+
+func TestSubscriberRetry(t *testing.T) {
+	ch := &fakeChannel{}
+	var encoded int
+
+	sub := NewSubscriber(
+		func(ctx context.Context, request interface{}) (interface{}, error) {
+			return nil, errors.New("endpoint error")
+		},
+		func(ctx context.Context, d *amqp.Delivery) (interface{}, error) {
+			assert.Equal(t, `exc`, d.Exchange)
+			assert.Equal(t, `retry.key`, d.RoutingKey)
+			return nil, nil
+		},
+		EncodeNopResponse,
+		SubscriberRetry(RetryPolicy{Queue: `retry_q`, MaxAttempts: 3}),
+		SubscriberErrorEncoder(func(ctx context.Context, err error, d *amqp.Delivery, ch Channel, pub *amqp.Publishing) {
+			encoded++
+			// the parked delivery is settled already
+			assert.NoError(t, d.Nack(false, true))
+		}),
+	)
+	fun := sub.ServeDelivery(ch)
+
+	ack := &fakeAcknowledger{}
+	d := amqp.Delivery{Acknowledger: ack, Exchange: `exc`, RoutingKey: `retry.key`, Body: []byte(`body`)}
+
+	for attempt := 1; attempt <= 3; attempt++ {
+		fun(&d)
+
+		require.Len(t, ch.published, attempt)
+		assert.Equal(t, attempt, ack.acks)
+		last := ch.published[attempt-1]
+		assert.Equal(t, ``, last.exchange)
+		assert.Equal(t, int32(attempt), last.msg.Headers[RetryAttemptsHeader])
+		assert.Equal(t, []byte(`body`), last.msg.Body)
+
+		// emulate dead-lettering back to the queue
+		d = amqp.Delivery{Acknowledger: ack, Exchange: ``, RoutingKey: `retry_q`, Headers: last.msg.Headers, Body: last.msg.Body}
+	}
+
+	assert.Equal(t, `retry_q.retry.1`, ch.published[0].key)
+	assert.Equal(t, `retry_q.retry.2`, ch.published[1].key)
+	assert.Equal(t, `retry_q.parking`, ch.published[2].key)
+	assert.Equal(t, `endpoint error`, ch.published[2].msg.Headers[LastErrorHeader])
+	assert.Equal(t, 3, ack.acks)
+	assert.Equal(t, 0, ack.nacks)
+	assert.Equal(t, 1, encoded)
+}
+
+func TestSubscriberRetryPublishError(t *testing.T) {
+	ch := &fakeChannel{err: errors.New("publish error")}
+
+	sub := NewSubscriber(
+		func(ctx context.Context, request interface{}) (interface{}, error) {
+			return nil, errors.New("endpoint error")
+		},
+		func(ctx context.Context, d *amqp.Delivery) (interface{}, error) {
+			return nil, nil
+		},
+		EncodeNopResponse,
+		SubscriberRetry(RetryPolicy{Queue: `retry_q`}),
+	)
+
+	ack := &fakeAcknowledger{}
+	sub.ServeDelivery(ch)(&amqp.Delivery{Acknowledger: ack})
+
+	assert.Equal(t, 0, ack.acks)
+	assert.Equal(t, 1, ack.nacks)
+	assert.True(t, ack.requeue)
+}
+
+func TestSubscriberRetryPermanentError(t *testing.T) {
+	ch := &fakeChannel{}
+	var encoded int
+
+	sub := NewSubscriber(
+		func(ctx context.Context, request interface{}) (interface{}, error) {
+			return nil, NewError(`bad request`, `bad_request`, http.StatusBadRequest)
+		},
+		func(ctx context.Context, d *amqp.Delivery) (interface{}, error) {
+			return nil, nil
+		},
+		EncodeNopResponse,
+		SubscriberRetry(RetryPolicy{Queue: `retry_q`}),
+		SubscriberErrorEncoder(func(ctx context.Context, err error, d *amqp.Delivery, ch Channel, pub *amqp.Publishing) {
+			encoded++
+		}),
+	)
+
+	ack := &fakeAcknowledger{}
+	sub.ServeDelivery(ch)(&amqp.Delivery{Acknowledger: ack})
+
+	assert.Empty(t, ch.published)
+	assert.Equal(t, 1, encoded)
+	// the encoder settles a delivery which is not retried
+	assert.Equal(t, 0, ack.acks+ack.nacks+ack.rejects)
+}
+
+func TestSubscriberRetryReplyByClass(t *testing.T) {
+	ch := &fakeChannel{}
+
+	sub := NewSubscriber(
+		func(ctx context.Context, request interface{}) (interface{}, error) {
+			return nil, errors.New("endpoint error")
+		},
+		func(ctx context.Context, d *amqp.Delivery) (interface{}, error) {
+			return nil, nil
+		},
+		EncodeNopResponse,
+		SubscriberRetry(RetryPolicy{Queue: `retry_q`, MaxAttempts: 2}),
+		SubscriberErrorEncoder(ReplyByClassErrorEncoder),
+	)
+
+	ack := &fakeAcknowledger{}
+	sub.ServeDelivery(ch)(&amqp.Delivery{
+		Acknowledger: ack,
+		Headers:      amqp.Table{RetryAttemptsHeader: int32(1)},
+		Body:         []byte(`body`),
+	})
+
+	require.Len(t, ch.published, 1)
+	assert.Equal(t, `retry_q.parking`, ch.published[0].key)
+	assert.Equal(t, 1, ack.acks)
+	assert.Equal(t, 0, ack.nacks)
+	assert.False(t, ack.requeue)
+}
@@ -0,0 +1,181 @@
+package amqp_kit
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/streadway/amqp"
+)
+
+// Route struct describes an endpoint for deliveries of a SubscribeInfo with routing keys matched by Key.
+// Key may be a topic pattern with * and #. For a headers exchange BindArgs are the binding arguments,
+// e.g. x-match and header values, and deliveries are matched by headers instead of Key.
+// Nil Enc means SubscribeInfo.Enc, O is appended to SubscribeInfo.O.
+type Route struct {
+	Key      string
+	BindArgs amqp.Table
+	E        endpoint.Endpoint
+	Dec      DecodeRequestFunc
+	Enc      EncodeResponseFunc
+	O        []SubscriberOption
+}
+
+// MatchTopic reports whether the routing key matches the topic pattern,
+// * matches exactly one word, # matches zero or more words
+func MatchTopic(pattern, key string) bool {
+	return matchWords(strings.Split(pattern, "."), strings.Split(key, "."))
+}
+
+// MatchHeaders reports whether the headers match the binding arguments of a headers exchange.
+// x-match is "all" by default or "any", arguments starting with "x-" are not matched unless
+// x-match is "all-with-x" or "any-with-x". A nil argument matches any value of the header.
+func MatchHeaders(args, headers amqp.Table) bool {
+	mode, _ := args["x-match"].(string)
+	any := strings.HasPrefix(mode, "any")
+	withX := strings.HasSuffix(mode, "-with-x")
+
+	for k, v := range args {
+		if k == "x-match" || !withX && strings.HasPrefix(k, "x-") {
+			continue
+		}
+
+		h, ok := headers[k]
+		matched := ok && (v == nil || reflect.DeepEqual(headerValue(v), headerValue(h)))
+		if matched == any {
+			return any
+		}
+	}
+
+	return !any
+}
+
+// headerValue converts integer and float values to int64 and float64, so they are compared by value
+func headerValue(v interface{}) interface{} {
+	switch n := v.(type) {
+	case int:
+		return int64(n)
+	case int8:
+		return int64(n)
+	case int16:
+		return int64(n)
+	case int32:
+		return int64(n)
+	case uint8:
+		return int64(n)
+	case uint16:
+		return int64(n)
+	case uint32:
+		return int64(n)
+	case float32:
+		return float64(n)
+	}
+	return v
+}
+
+func matchWords(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if matchWords(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && matchWords(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && pattern[0] == words[0] && matchWords(pattern[1:], words[1:])
+	}
+}
+
+// router dispatches deliveries of one consumer to subscribers by routing key
+type router struct {
+	kind   string
+	routes []routeHandler
+	def    *routeHandler
+}
+
+type routeHandler struct {
+	keys []string
+	args amqp.Table
+	sub  Subscriber
+	fun  func(deliv *amqp.Delivery)
+}
+
+// newRouter creates subscribers of routes and of the SubscribeInfo endpoint if set, routes are matched first
+func newRouter(si *SubscribeInfo, kind string, ch Channel, opts []SubscriberOption) *router {
+	r := &router{kind: kind}
+
+	for _, route := range si.Routes {
+		enc := route.Enc
+		if enc == nil {
+			enc = si.Enc
+		}
+		sub := NewSubscriber(route.E, route.Dec, enc, append(opts[:len(opts):len(opts)], route.O...)...)
+		r.routes = append(r.routes, routeHandler{keys: []string{route.Key}, args: route.BindArgs, sub: *sub, fun: sub.ServeDelivery(ch)})
+	}
+
+	if si.E != nil {
+		sub := NewSubscriber(si.E, si.Dec, si.Enc, opts...)
+		r.def = &routeHandler{keys: si.ownKeys(), args: si.BindArgs, sub: *sub, fun: sub.ServeDelivery(ch)}
+	}
+
+	return r
+}
+
+// handler returns the function serving the delivery, nil if no one matches.
+// Deliveries of a fanout exchange match every route.
+func (r *router) handler(d *amqp.Delivery) func(deliv *amqp.Delivery) {
+	for _, route := range r.routes {
+		if route.match(r.kind, d) {
+			return route.fun
+		}
+	}
+	if r.def != nil && r.def.match(r.kind, d) {
+		return r.def.fun
+	}
+
+	return nil
+}
+
+func (h *routeHandler) match(kind string, d *amqp.Delivery) bool {
+	switch kind {
+	case amqp.ExchangeFanout:
+		return true
+	case amqp.ExchangeHeaders:
+		return MatchHeaders(h.args, d.Headers)
+	}
+
+	for _, k := range h.keys {
+		if k == d.RoutingKey || kind == amqp.ExchangeTopic && MatchTopic(k, d.RoutingKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryPolicies returns distinct retry policies of subscribers
+func (r *router) retryPolicies() []*RetryPolicy {
+	var policies []*RetryPolicy
+	seen := make(map[*RetryPolicy]struct{})
+	handlers := r.routes
+	if r.def != nil {
+		handlers = append(handlers[:len(handlers):len(handlers)], *r.def)
+	}
+
+	for _, route := range handlers {
+		if p := route.sub.retry; p != nil {
+			if _, ok := seen[p]; !ok {
+				seen[p] = struct{}{}
+				policies = append(policies, p)
+			}
+		}
+	}
+
+	return policies
+}
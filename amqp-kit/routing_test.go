@@ -0,0 +1,110 @@
+package amqp_kit
+
+import (
+	"context"
+	"testing"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchTopic(t *testing.T) {
+	cases := []struct {
+		pattern, key string
+		match        bool
+	}{
+		{"a.b", "a.b", true},
+		{"a.b", "a.c", false},
+		{"a.*", "a.b", true},
+		{"a.*", "a.b.c", false},
+		{"a.#", "a", true},
+		{"a.#", "a.b.c", true},
+		{"#", "a.b", true},
+		{"#.c", "a.b.c", true},
+		{"*.b.#", "a.b", true},
+		{"*.b.#", "b", false},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.match, MatchTopic(c.pattern, c.key), "%s %s", c.pattern, c.key)
+	}
+}
+
+func TestRouter(t *testing.T) {
+	var called []string
+	handler := func(name string) Route {
+		return Route{
+			E: func(ctx context.Context, request interface{}) (interface{}, error) {
+				called = append(called, name+":"+request.(string))
+				return nil, nil
+			},
+			Dec: func(ctx context.Context, d *amqp.Delivery) (interface{}, error) {
+				return d.RoutingKey, nil
+			},
+		}
+	}
+
+	orders, all := handler("orders"), handler("all")
+	orders.Key, all.Key = "order.*", "#"
+	def := handler("default")
+	si := &SubscribeInfo{
+		Key:    "user.created",
+		E:      def.E,
+		Dec:    def.Dec,
+		Enc:    EncodeNopResponse,
+		Routes: []Route{orders, all},
+	}
+
+	r := newRouter(si, amqp.ExchangeTopic, &fakeChannel{}, nil)
+	for _, key := range []string{"order.created", "user.created", "user.deleted"} {
+		fun := r.handler(&amqp.Delivery{RoutingKey: key})
+		require.NotNil(t, fun, key)
+		fun(&amqp.Delivery{RoutingKey: key, Acknowledger: &fakeAcknowledger{}})
+	}
+	assert.Equal(t, []string{"orders:order.created", "all:user.created", "all:user.deleted"}, called)
+
+	// the default endpoint gets own keys only
+	si.Routes = []Route{orders}
+	r = newRouter(si, amqp.ExchangeTopic, &fakeChannel{}, nil)
+	assert.NotNil(t, r.handler(&amqp.Delivery{RoutingKey: "user.created"}))
+	assert.Nil(t, r.handler(&amqp.Delivery{RoutingKey: "user.deleted"}))
+
+	r = newRouter(si, amqp.ExchangeDirect, &fakeChannel{}, nil)
+	assert.Nil(t, r.handler(&amqp.Delivery{RoutingKey: "order.created"}))
+
+	// every route matches deliveries of a fanout exchange, routes are matched first
+	called = nil
+	r = newRouter(si, amqp.ExchangeFanout, &fakeChannel{}, nil)
+	r.handler(&amqp.Delivery{RoutingKey: "any"})(&amqp.Delivery{RoutingKey: "any", Acknowledger: &fakeAcknowledger{}})
+	assert.Equal(t, []string{"orders:any"}, called)
+
+	// deliveries of a headers exchange are matched by binding arguments
+	orders.BindArgs = amqp.Table{"x-match": "all", "type": "order", "tenant": nil}
+	si.Routes = []Route{orders}
+	si.BindArgs = amqp.Table{"type": "user"}
+	r = newRouter(si, amqp.ExchangeHeaders, &fakeChannel{}, nil)
+	called = nil
+	for _, headers := range []amqp.Table{{"type": "order", "tenant": int32(1)}, {"type": "user"}} {
+		fun := r.handler(&amqp.Delivery{Headers: headers})
+		require.NotNil(t, fun, headers)
+		fun(&amqp.Delivery{RoutingKey: "h", Headers: headers, Acknowledger: &fakeAcknowledger{}})
+	}
+	assert.Equal(t, []string{"orders:h", "default:h"}, called)
+	assert.Nil(t, r.handler(&amqp.Delivery{Headers: amqp.Table{"type": "order"}}))
+	assert.Nil(t, r.handler(&amqp.Delivery{Headers: amqp.Table{"type": "payment"}}))
+}
+
+func TestMatchHeaders(t *testing.T) {
+	args := amqp.Table{"x-match": "all", "format": "pdf", "pages": int32(2)}
+	assert.True(t, MatchHeaders(args, amqp.Table{"format": "pdf", "pages": int64(2), "extra": true}))
+	assert.False(t, MatchHeaders(args, amqp.Table{"format": "pdf"}))
+
+	args["x-match"] = "any"
+	assert.True(t, MatchHeaders(args, amqp.Table{"format": "pdf"}))
+	assert.False(t, MatchHeaders(args, amqp.Table{"format": "zip"}))
+
+	// x- arguments are matched with -with-x modes only
+	assert.True(t, MatchHeaders(amqp.Table{"x-tenant": "1"}, amqp.Table{}))
+	assert.False(t, MatchHeaders(amqp.Table{"x-match": "all-with-x", "x-tenant": "1"}, amqp.Table{}))
+}
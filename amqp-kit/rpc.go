@@ -0,0 +1,213 @@
+package amqp_kit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/opentracing-contrib/go-amqp/amqptracer"
+	"github.com/opentracing/opentracing-go"
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// DirectReplyTo is the RabbitMQ pseudo-queue for replies without a declared queue
+const DirectReplyTo = "amq.rabbitmq.reply-to"
+
+// ErrReplyConsumerClosed is returned by Call when the reply consumer stops before the reply arrives
+var ErrReplyConsumerClosed = errors.New("amqp_kit: reply consumer closed")
+
+// Caller interface use for request/reply over amqp
+type Caller interface {
+	Call(ctx context.Context, exchange, key string, body []byte) (json.RawMessage, error)
+}
+
+// rpcClient owns the channel consuming replies. Direct reply-to requires requests
+// to be published on the same channel, so publishing is serialized.
+type rpcClient struct {
+	ch          AMQPChannel
+	replyTo     string
+	pubLock     sync.Mutex
+	pendingLock sync.Mutex
+	pending     map[string]chan amqp.Delivery
+	done        chan struct{}
+}
+
+// Call publishes body with a correlation ID and a reply queue and waits for the matching reply.
+// The reply is expected to be a Response envelope: Data is returned as is, Error is returned as *Error.
+// The reply queue is Config.ReplyQueue or RabbitMQ direct reply-to if empty.
+func (c *Client) Call(ctx context.Context, exchange, key string, body []byte) (json.RawMessage, error) {
+	r, err := c.getRPC()
+	if err != nil {
+		return nil, err
+	}
+
+	corID, err := newCorrelationID()
+	if err != nil {
+		return nil, err
+	}
+
+	replyChan := make(chan amqp.Delivery, 1)
+	r.add(corID, replyChan)
+	defer r.remove(corID)
+
+	pub := amqp.Publishing{
+		Headers:       amqp.Table{},
+		ContentType:   ContentTypeJSON,
+		CorrelationId: corID,
+		ReplyTo:       r.replyTo,
+		Body:          body,
+	}
+
+	// the request is useless for the caller after the deadline
+	if deadline, ok := ctx.Deadline(); ok {
+		ttl := time.Until(deadline) / time.Millisecond
+		if ttl <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+		pub.Expiration = strconv.FormatInt(int64(ttl), 10)
+		pub.Headers[DeadlineHeader] = deadline.UnixNano() / int64(time.Millisecond)
+	}
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		if err := amqptracer.Inject(span, pub.Headers); err != nil {
+			log.Printf("call: error inject headers: %s", err)
+		}
+	}
+
+	if err = r.publish(c, exchange, key, &pub); err != nil {
+		return nil, err
+	}
+
+	select {
+	case d := <-replyChan:
+		return decodeResponse(d.Body)
+	case <-r.done:
+		return nil, ErrReplyConsumerClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// getRPC returns the reply consumer, starting a new one after reconnect
+func (c *Client) getRPC() (*rpcClient, error) {
+	c.rpcLock.Lock()
+	defer c.rpcLock.Unlock()
+
+	if c.rpc != nil {
+		select {
+		case <-c.rpc.done:
+		default:
+			return c.rpc, nil
+		}
+	}
+
+	conn := c.getConnection()
+	ch, err := conn.amqpConn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("AMQP: Channel create err: %s", err.Error())
+	}
+
+	replyTo := c.config.ReplyQueue
+	if replyTo == "" {
+		replyTo = DirectReplyTo
+	} else if _, err = ch.QueueDeclare(replyTo, false, true, true, false, nil); err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("AMQP: Reply queue declare err: %s", err.Error())
+	}
+
+	msgs, err := ch.Consume(replyTo, "", true, true, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("AMQP: Reply consume err: %s", err.Error())
+	}
+
+	r := &rpcClient{
+		ch:      ch,
+		replyTo: replyTo,
+		pending: make(map[string]chan amqp.Delivery),
+		done:    make(chan struct{}),
+	}
+	go r.listen(msgs)
+	c.rpc = r
+
+	return r, nil
+}
+
+func (r *rpcClient) listen(msgs <-chan amqp.Delivery) {
+	defer close(r.done)
+
+	for d := range msgs {
+		r.pendingLock.Lock()
+		replyChan, ok := r.pending[d.CorrelationId]
+		delete(r.pending, d.CorrelationId)
+		r.pendingLock.Unlock()
+
+		if !ok {
+			log.Warnf(`AMQP: unexpected reply, correlation id: %s`, d.CorrelationId)
+			continue
+		}
+		replyChan <- d
+	}
+}
+
+func (r *rpcClient) publish(c *Client, exchange, key string, pub *amqp.Publishing) error {
+	r.pubLock.Lock()
+	defer r.pubLock.Unlock()
+
+	if err := c.checkExchange(&channel{c: r.ch}, exchange); err != nil {
+		return err
+	}
+
+	if err := r.ch.Publish(exchange, key, false, false, *pub); err != nil {
+		return fmt.Errorf("AMQP: Exchange Publish err: %s", err.Error())
+	}
+
+	return nil
+}
+
+func (r *rpcClient) add(corID string, replyChan chan amqp.Delivery) {
+	r.pendingLock.Lock()
+	defer r.pendingLock.Unlock()
+
+	r.pending[corID] = replyChan
+}
+
+func (r *rpcClient) remove(corID string) {
+	r.pendingLock.Lock()
+	defer r.pendingLock.Unlock()
+
+	delete(r.pending, corID)
+}
+
+func decodeResponse(body []byte) (json.RawMessage, error) {
+	var resp struct {
+		Data  json.RawMessage `json:"data"`
+		Error *Error          `json:"error"`
+	}
+
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+
+	return resp.Data, nil
+}
+
+func newCorrelationID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
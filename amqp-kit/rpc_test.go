@@ -0,0 +1,102 @@
+package amqp_kit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestDecodeResponse(t *testing.T) {
+	data, err := decodeResponse([]byte(`{"data":{"foo":"bar"}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, json.RawMessage(`{"foo":"bar"}`), data)
+
+	_, err = decodeResponse([]byte(`{"error":{"code":"err_message","message":"err-message","status_code":400}}`))
+	assert.Equal(t, NewError(`err-message`, `err_message`, http.StatusBadRequest), err)
+
+	_, err = decodeResponse([]byte(`not json`))
+	assert.Error(t, err)
+}
+
+func TestGetRPCClosesChannel(t *testing.T) {
+	for _, ch := range []*fakeAMQPChannel{
+		{declareErr: errors.New("declare error")},
+		{consumeErr: errors.New("consume error")},
+	} {
+		c := &Client{
+			config: &Config{ReplyQueue: `replies`},
+			conn:   &connection{amqpConn: &fakeConnection{channel: ch}},
+		}
+
+		_, err := c.getRPC()
+		assert.Error(t, err)
+		assert.True(t, ch.isClosed())
+	}
+}
+
+type rpcSuite struct {
+	suite.Suite
+	config *Config
+}
+
+func (s *rpcSuite) SetupSuite() {
+	s.config = &Config{Address: rabbitTestAddr, User: "guest", Password: "guest"}
+}
+
+func (s *rpcSuite) TearDownSuite() {}
+
+func TestRPCSuite(t *testing.T) {
+	suite.Run(t, new(rpcSuite))
+}
+
+func (s *rpcSuite) TestCall() {
+	subs := []SubscribeInfo{
+		{
+			Queue:    `rpc_echo`,
+			Exchange: `rpc`,
+			E: func(ctx context.Context, request interface{}) (response interface{}, err error) {
+				if string(request.([]byte)) == `"fail"` {
+					return nil, NewError(`err-message`, `err_message`, http.StatusBadRequest)
+				}
+				if string(request.([]byte)) == `"sleep"` {
+					time.Sleep(time.Second)
+				}
+				return Response{Data: json.RawMessage(request.([]byte))}, nil
+			},
+			Dec: func(i context.Context, delivery *amqp.Delivery) (request interface{}, err error) {
+				return delivery.Body, nil
+			},
+			Enc: EncodeJSONResponse,
+			O:   []SubscriberOption{SubscriberAfter(SetAckAfterEndpoint(false))},
+		},
+	}
+
+	cl, err := New(s.config)
+	s.Require().NoError(err)
+	s.Require().NoError(cl.Serve(subs))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	data, err := cl.Call(ctx, `rpc`, `rpc.echo`, []byte(`{"foo":"bar"}`))
+	s.Require().NoError(err)
+	s.Equal(json.RawMessage(`{"foo":"bar"}`), data)
+
+	_, err = cl.Call(ctx, `rpc`, `rpc.echo`, []byte(`"fail"`))
+	s.Equal(NewError(`err-message`, `err_message`, http.StatusBadRequest), err)
+
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer shortCancel()
+
+	_, err = cl.Call(shortCtx, `rpc`, `rpc.echo`, []byte(`"sleep"`))
+	s.Equal(context.DeadlineExceeded, err)
+
+	s.Require().NoError(cl.Close())
+}
@@ -0,0 +1,57 @@
+package amqp_kit
+
+import (
+	"context"
+	"sync"
+
+	"github.com/space307/go-utils/v3/sg"
+)
+
+var (
+	// Server must satisfy the sg.Server interface.
+	_ sg.Server = (*Server)(nil)
+)
+
+// Server adapts Client with subscriptions to the sg.Server interface
+type Server struct {
+	client   *Client
+	subs     []SubscribeInfo
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewServer creates a new server object for the given client and subscriptions
+func NewServer(c *Client, subs []SubscribeInfo) *Server {
+	return &Server{
+		client: c,
+		subs:   subs,
+		stop:   make(chan struct{}),
+	}
+}
+
+// Serve starts consumers and blocks until Stop is called.
+func (s *Server) Serve() error {
+	if err := s.client.Serve(s.subs); err != nil {
+		return err
+	}
+
+	<-s.stop
+	return nil
+}
+
+// Stop gracefully shutdowns the client waiting for in-flight deliveries
+// not longer than Config.ShutdownTimeout.
+func (s *Server) Stop() error {
+	timeout := s.client.config.ShutdownTimeout
+	if timeout == 0 {
+		timeout = defaultShutdownTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := s.client.Shutdown(ctx)
+	s.stopOnce.Do(func() { close(s.stop) })
+
+	return err
+}
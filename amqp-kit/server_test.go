@@ -0,0 +1,89 @@
+package amqp_kit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/space307/go-utils/v3/sg"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestClientShutdownWaitsInFlight(t *testing.T) {
+	cl := &Client{
+		config:         &Config{},
+		stopClientChan: make(chan struct{}),
+		consumers:      make(map[*consumer]struct{}),
+	}
+
+	require.True(t, cl.startHandling())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, cl.Shutdown(ctx))
+	assert.False(t, cl.startHandling())
+
+	cl.inFlight.Done()
+	assert.NoError(t, cl.Shutdown(context.Background()))
+}
+
+type serverSuite struct {
+	suite.Suite
+}
+
+func TestServerSuite(t *testing.T) {
+	suite.Run(t, new(serverSuite))
+}
+
+func (s *serverSuite) TestServerDrain() {
+	started := make(chan struct{})
+	finished := make(chan struct{}, 1)
+
+	subs := []SubscribeInfo{
+		{
+			Queue:    `server_drain`,
+			Exchange: `server`,
+			E: func(ctx context.Context, request interface{}) (response interface{}, err error) {
+				close(started)
+				time.Sleep(500 * time.Millisecond)
+				finished <- struct{}{}
+				return nil, nil
+			},
+			Dec: func(i context.Context, delivery *amqp.Delivery) (request interface{}, err error) {
+				return nil, nil
+			},
+			Enc: EncodeNopResponse,
+			O:   []SubscriberOption{SubscriberAfter(SetAckAfterEndpoint(false))},
+		},
+	}
+
+	cl, err := New(&Config{Address: rabbitTestAddr, User: "guest", Password: "guest", ShutdownTimeout: 5 * time.Second})
+	s.Require().NoError(err)
+
+	group := sg.New(NewServer(cl, subs))
+	res := make(chan error, 1)
+	go func() { res <- group.Serve() }()
+	// wait for consumers
+	time.Sleep(time.Second)
+
+	s.Require().NoError(cl.Publish(`server`, `server.drain`, ``, []byte(`{}`)))
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		s.FailNow("timeout. waiting for handler")
+	}
+
+	s.Require().NoError(group.Stop())
+
+	select {
+	case <-finished:
+	default:
+		s.Fail("handler was not drained")
+	}
+
+	s.NoError(<-res)
+}
@@ -3,9 +3,16 @@ package amqp_kit
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"runtime/debug"
+	"strconv"
+	"time"
 
 	"github.com/go-kit/kit/endpoint"
 	"github.com/opentracing-contrib/go-amqp/amqptracer"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	log "github.com/sirupsen/logrus"
 	"github.com/streadway/amqp"
 )
 
@@ -32,6 +39,14 @@ type Subscriber struct {
 	before       []RequestFunc
 	after        []SubscriberResponseFunc
 	errorEncoder ErrorEncoder
+	retry        *RetryPolicy
+	metrics      *Metrics
+	queue        string
+	ctx          context.Context
+	panicEncoder ErrorEncoder
+	dedup        *dedup
+	tracer       opentracing.Tracer
+	spanRef      opentracing.SpanReferenceType
 }
 
 // NewSubscriber constructs a new subscriber, which provides a handler
@@ -72,17 +87,112 @@ func SubscriberErrorEncoder(ee ErrorEncoder) SubscriberOption {
 	return func(s *Subscriber) { s.errorEncoder = ee }
 }
 
+// SubscriberContext sets the parent context of every delivery context,
+// cancelling it cancels handlers. By default it is context.Background.
+// Client sets its own context, which is cancelled on Close.
+func SubscriberContext(ctx context.Context) SubscriberOption {
+	return func(s *Subscriber) { s.ctx = ctx }
+}
+
+// SubscriberPanicEncoder is used to encode an endpoint panic recovered as *PanicError.
+// By default panics are handled as other errors. NackErrorEncoder allows
+// to nack or requeue the delivery instead.
+func SubscriberPanicEncoder(ee ErrorEncoder) SubscriberOption {
+	return func(s *Subscriber) { s.panicEncoder = ee }
+}
+
 // ServeDelivery handles AMQP Delivery messages
 // It is strongly recommended to use *amqp.Channel as the
-// Channel interface implementation
+// Channel interface implementation.
+// The delivery context has a deadline from Expiration or DeadlineHeader if set.
 func (s Subscriber) ServeDelivery(ch Channel) func(deliv *amqp.Delivery) {
 
 	return func(deliv *amqp.Delivery) {
-		ctx, cancel := context.WithCancel(context.Background())
+		// the channel is wrapped per delivery
+		ch := ch
+
+		parent := s.ctx
+		if parent == nil {
+			parent = context.Background()
+		}
+
+		var (
+			ctx    context.Context
+			cancel context.CancelFunc
+		)
+		if deadline, ok := deliveryDeadline(deliv); ok {
+			ctx, cancel = context.WithDeadline(parent, deadline)
+		} else {
+			ctx, cancel = context.WithCancel(parent)
+		}
 		defer cancel()
 
+		var span opentracing.Span
+		if s.tracer != nil {
+			var ack *outcomeAcknowledger
+			if deliv.Acknowledger != nil {
+				ack = &outcomeAcknowledger{Acknowledger: deliv.Acknowledger, outcome: OutcomeNone}
+				deliv.Acknowledger = ack
+			}
+
+			span = s.startConsumeSpan(deliv)
+			defer func() {
+				if ack != nil {
+					span.SetTag(tagOutcome, ack.outcome)
+				}
+				span.Finish()
+			}()
+			ctx = opentracing.ContextWithSpan(ctx, span)
+			ch = &tracingChannel{Channel: ch, tracer: s.tracer, span: span}
+		}
+		fail := func(stage string, err error) {
+			if span != nil {
+				ext.Error.Set(span, true)
+				span.SetTag(tagError, err.Error())
+				span.SetTag(tagStage, stage)
+			}
+		}
+
+		if s.metrics != nil && deliv.Acknowledger != nil {
+			ack := &outcomeAcknowledger{Acknowledger: deliv.Acknowledger, outcome: OutcomeNone}
+			deliv.Acknowledger = ack
+			defer func(begin time.Time) { s.metrics.delivery(s.queue, ack.outcome, begin) }(time.Now())
+		}
+
 		pub := amqp.Publishing{
-			ContentType: "application/json",
+			ContentType: ContentTypeJSON,
+		}
+
+		defer func() {
+			if r := recover(); r != nil {
+				err := &PanicError{Value: r, Stack: debug.Stack()}
+				log.Errorf("AMQP: endpoint panic: %v\n%s", r, err.Stack)
+				fail(stagePanic, err)
+
+				if s.panicEncoder != nil {
+					s.panicEncoder(ctx, err, deliv, ch, &pub)
+					return
+				}
+				s.handleError(ctx, err, deliv, ch, &pub)
+			}
+		}()
+
+		if s.retry != nil {
+			restoreRouting(deliv)
+		}
+
+		var (
+			dedupKey string
+			replyCh  *recordingChannel
+		)
+		if s.dedup != nil {
+			if dedupKey = s.dedup.key(deliv); dedupKey != "" {
+				if s.dedup.replay(ctx, dedupKey, deliv, ch) {
+					return
+				}
+				replyCh = &recordingChannel{Channel: ch}
+				ch = replyCh
+			}
 		}
 
 		for _, f := range s.before {
@@ -95,13 +205,19 @@ func (s Subscriber) ServeDelivery(ch Channel) func(deliv *amqp.Delivery) {
 
 		request, err := s.dec(ctx, deliv)
 		if err != nil {
-			s.errorEncoder(ctx, err, deliv, ch, &pub)
+			// malformed messages are poison unless the decoder tells otherwise
+			if _, ok := err.(*Error); !ok {
+				err = &DecodeError{Err: err}
+			}
+			fail(stageDecode, err)
+			s.handleError(ctx, err, deliv, ch, &pub)
 			return
 		}
 
 		response, err := s.e(ctx, request)
 		if err != nil {
-			s.errorEncoder(ctx, err, deliv, ch, &pub)
+			fail(stageEndpoint, err)
+			s.handleError(ctx, err, deliv, ch, &pub)
 			return
 		}
 
@@ -110,37 +226,107 @@ func (s Subscriber) ServeDelivery(ch Channel) func(deliv *amqp.Delivery) {
 		}
 
 		if err := s.enc(ctx, deliv, ch, &pub, response); err != nil {
-			s.errorEncoder(ctx, err, deliv, ch, &pub)
+			fail(stageEncode, err)
+			s.handleError(ctx, err, deliv, ch, &pub)
 			return
 		}
+
+		if replyCh != nil {
+			s.dedup.record(ctx, dedupKey, replyCh)
+		}
 	}
 }
 
 // EncodeJSONResponse marshals the response as JSON and sends the response
 // to the given channel as a reply.
 func EncodeJSONResponse(ctx context.Context, deliv *amqp.Delivery, ch Channel, pub *amqp.Publishing, response interface{}) error {
+	b, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+
+	return publishReply(ctx, deliv, ch, pub, ContentTypeJSON, b)
+}
+
+// publishReply sends the body to the reply exchange and key of the context or to the ReplyTo
+// of the delivery. The content type is set only if a hook has not set it.
+func publishReply(ctx context.Context, deliv *amqp.Delivery, ch Channel, pub *amqp.Publishing, contentType string, body []byte) error {
 	if pub.CorrelationId == "" {
 		pub.CorrelationId = deliv.CorrelationId
 	}
+	if pub.ContentType == "" {
+		pub.ContentType = contentType
+	}
 
 	replyExchange := getPublishExchange(ctx)
 	replyTo := getPublishKey(ctx)
 	if replyTo == "" {
 		replyTo = deliv.ReplyTo
 	}
+	pub.Body = body
 
-	b, err := json.Marshal(response)
-	if err != nil {
-		return err
-	}
-	pub.Body = b
-
-	err = ch.Publish(replyExchange, replyTo, false, false, *pub)
-
-	return err
+	return ch.Publish(replyExchange, replyTo, false, false, *pub)
 }
 
 // EncodeNopResponse is a response function that does nothing.
 func EncodeNopResponse(_ context.Context, _ *amqp.Delivery, _ Channel, _ *amqp.Publishing, _ interface{}) error {
 	return nil
 }
+
+// DeadlineHeader holds the deadline of a message processing in unix milliseconds
+const DeadlineHeader = "x-deadline"
+
+// PanicError is an endpoint panic recovered by Subscriber
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+// Error returns panic message.
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("amqp_kit: panic: %v", e.Value)
+}
+
+// DecodeError is an error of the request decoder, except *Error, wrapped by Subscriber
+type DecodeError struct {
+	Err error
+}
+
+// Error returns the decoder error message.
+func (e *DecodeError) Error() string {
+	return e.Err.Error()
+}
+
+// deliveryDeadline returns the earliest of DeadlineHeader and Timestamp + Expiration
+func deliveryDeadline(d *amqp.Delivery) (time.Time, bool) {
+	var (
+		deadline time.Time
+		ok       bool
+	)
+
+	if d.Expiration != "" {
+		if ms, err := strconv.ParseInt(d.Expiration, 10, 64); err == nil {
+			start := d.Timestamp
+			if start.IsZero() {
+				start = time.Now()
+			}
+			deadline, ok = start.Add(time.Duration(ms)*time.Millisecond), true
+		}
+	}
+
+	var ms int64
+	switch v := d.Headers[DeadlineHeader].(type) {
+	case int64:
+		ms = v
+	case int32:
+		ms = int64(v)
+	}
+	if ms > 0 {
+		t := time.Unix(0, ms*int64(time.Millisecond))
+		if !ok || t.Before(deadline) {
+			deadline, ok = t, true
+		}
+	}
+
+	return deadline, ok
+}
@@ -10,6 +10,8 @@ import (
 	"github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/mocktracer"
 	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -118,3 +120,134 @@ func (s *subsSuite) TestSubscriberTracing() {
 	err = cl.Close()
 	s.Require().NoError(err)
 }
+
+func TestDeliveryDeadline(t *testing.T) {
+	_, ok := deliveryDeadline(&amqp.Delivery{})
+	assert.False(t, ok)
+
+	ts := time.Unix(1000, 0)
+	deadline, ok := deliveryDeadline(&amqp.Delivery{Timestamp: ts, Expiration: "1500"})
+	assert.True(t, ok)
+	assert.Equal(t, ts.Add(1500*time.Millisecond), deadline)
+
+	// the earliest deadline wins
+	header := ts.Add(time.Second)
+	deadline, ok = deliveryDeadline(&amqp.Delivery{
+		Timestamp:  ts,
+		Expiration: "1500",
+		Headers:    amqp.Table{DeadlineHeader: header.UnixNano() / int64(time.Millisecond)},
+	})
+	assert.True(t, ok)
+	assert.True(t, header.Equal(deadline))
+}
+
+func TestSubscriberContext(t *testing.T) {
+	parent, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var handlerErr error
+	sub := NewSubscriber(
+		func(ctx context.Context, request interface{}) (interface{}, error) {
+			handlerErr = ctx.Err()
+			_, hasDeadline := ctx.Deadline()
+			assert.True(t, hasDeadline)
+			return nil, nil
+		},
+		func(ctx context.Context, d *amqp.Delivery) (interface{}, error) { return nil, nil },
+		EncodeNopResponse,
+		SubscriberContext(parent),
+	)
+
+	sub.ServeDelivery(&fakeChannel{})(&amqp.Delivery{Acknowledger: &fakeAcknowledger{}, Expiration: "60000"})
+	assert.Equal(t, context.Canceled, handlerErr)
+}
+
+func TestSubscriberPanic(t *testing.T) {
+	endpoint := func(ctx context.Context, request interface{}) (interface{}, error) {
+		panic("boom")
+	}
+	dec := func(ctx context.Context, d *amqp.Delivery) (interface{}, error) { return nil, nil }
+
+	var encodedErr error
+	sub := NewSubscriber(endpoint, dec, EncodeNopResponse,
+		SubscriberErrorEncoder(func(ctx context.Context, err error, d *amqp.Delivery, ch Channel, pub *amqp.Publishing) {
+			encodedErr = err
+			d.Ack(false)
+		}),
+	)
+
+	ack := &fakeAcknowledger{}
+	sub.ServeDelivery(&fakeChannel{})(&amqp.Delivery{Acknowledger: ack})
+
+	require.IsType(t, &PanicError{}, encodedErr)
+	assert.Equal(t, "amqp_kit: panic: boom", encodedErr.Error())
+	assert.Equal(t, 1, ack.acks)
+
+	sub = NewSubscriber(endpoint, dec, EncodeNopResponse, SubscriberPanicEncoder(NackErrorEncoder(true)))
+
+	ack = &fakeAcknowledger{}
+	sub.ServeDelivery(&fakeChannel{})(&amqp.Delivery{Acknowledger: ack})
+
+	assert.Equal(t, 0, ack.acks)
+	assert.Equal(t, 1, ack.nacks)
+	assert.True(t, ack.requeue)
+}
+
+func TestSubscriberTracingOption(t *testing.T) {
+	tracer := mocktracer.New()
+
+	parent := tracer.StartSpan(`publish`)
+	headers := amqp.Table{}
+	require.NoError(t, tracer.Inject(parent.Context(), opentracing.TextMap, headersCarrier(headers)))
+	parent.Finish()
+
+	var endpointSpan opentracing.Span
+	sub := NewSubscriber(
+		endpoint.Chain(TraceEndpoint(tracer, `test_endpoint`))(func(ctx context.Context, request interface{}) (interface{}, error) {
+			endpointSpan = opentracing.SpanFromContext(ctx)
+			if request.(string) == `fail` {
+				return nil, fmt.Errorf("endpoint error")
+			}
+			return `ok`, nil
+		}),
+		func(ctx context.Context, d *amqp.Delivery) (interface{}, error) { return string(d.Body), nil },
+		EncodeJSONResponse,
+		SubscriberTracing(tracer, opentracing.FollowsFromRef),
+		SubscriberAfter(SetAckAfterEndpoint(false)),
+	)
+
+	ch := &fakeChannel{}
+	sub.ServeDelivery(ch)(&amqp.Delivery{
+		Acknowledger: &fakeAcknowledger{},
+		Headers:      headers,
+		RoutingKey:   `trace.key`,
+		ReplyTo:      `reply`,
+		Body:         []byte(`ok`),
+	})
+
+	spans := tracer.FinishedSpans()
+	require.Len(t, spans, 3)
+	consumer := spans[2]
+	assert.Equal(t, `consume_key: trace.key`, consumer.OperationName)
+	assert.Equal(t, parent.Context().(mocktracer.MockSpanContext).SpanID, consumer.ParentID)
+	assert.Equal(t, OutcomeAck, consumer.Tag(tagOutcome))
+	assert.Nil(t, consumer.Tag(tagError))
+	assert.Equal(t, consumer.SpanContext.SpanID, endpointSpan.(*mocktracer.MockSpan).ParentID)
+
+	// the reply carries the consumer span context
+	require.Len(t, ch.published, 1)
+	replyCtx, err := tracer.Extract(opentracing.TextMap, headersCarrier(ch.published[0].msg.Headers))
+	require.NoError(t, err)
+	assert.Equal(t, consumer.SpanContext.SpanID, replyCtx.(mocktracer.MockSpanContext).SpanID)
+
+	tracer.Reset()
+	sub.ServeDelivery(&fakeChannel{})(&amqp.Delivery{Acknowledger: &fakeAcknowledger{}, Body: []byte(`fail`)})
+
+	spans = tracer.FinishedSpans()
+	require.Len(t, spans, 2)
+	consumer = spans[1]
+	assert.Equal(t, 0, consumer.ParentID)
+	assert.Equal(t, `endpoint error`, consumer.Tag(tagError))
+	assert.Equal(t, stageEndpoint, consumer.Tag(tagStage))
+	assert.Equal(t, OutcomeAck, consumer.Tag(tagOutcome))
+}
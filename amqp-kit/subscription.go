@@ -0,0 +1,262 @@
+package amqp_kit
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// SubscriptionStarting is a state before all consumers of a subscription are started.
+	SubscriptionStarting int32 = 0
+	// SubscriptionActive is a state when all consumers are running.
+	SubscriptionActive int32 = 1
+	// SubscriptionRestarting is a state after a consumer was stopped by a channel or connection close.
+	SubscriptionRestarting int32 = 2
+	// SubscriptionCancelled is a state after a call to Cancel.
+	SubscriptionCancelled int32 = 3
+)
+
+// Subscription is a handle of consumers of a queue started by Client.Subscribe
+type Subscription interface {
+	// Cancel stops consumers and waits until in-flight deliveries are handled or ctx is done
+	Cancel(ctx context.Context) error
+	// Status returns the current state of consumers
+	Status() SubscriptionStatus
+}
+
+// SubscriptionStatus struct describes consumers of a subscription.
+// Consumers is the number of running consumers, Restarts is the number of consumers
+// started again after a channel close, LastError is the last error of starting a consumer.
+type SubscriptionStatus struct {
+	Queue     string
+	State     int32
+	Consumers int
+	Restarts  int
+	LastError error
+}
+
+// subscription runs SubscribeInfo.Workers consumers, which are started again until it is cancelled
+type subscription struct {
+	c         *Client
+	si        *SubscribeInfo
+	stop      chan struct{}
+	stopOnce  sync.Once
+	ready     chan struct{}
+	workers   sync.WaitGroup
+	lock      sync.Mutex
+	started   int
+	consumers int
+	restarts  int
+	lastErr   error
+}
+
+// Subscribe starts consumers of the queue, they are restored after reconnects like the ones started by Serve.
+// It waits for consumers up to Config.WaitWorkerDuration.
+func (c *Client) Subscribe(si SubscribeInfo) (Subscription, error) {
+	s, err := c.subscribe(si)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = s.wait(time.After(c.waitWorkerDuration())); err != nil {
+		_ = s.Cancel(context.Background())
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// subscribe registers the subscription and starts its workers
+func (c *Client) subscribe(si SubscribeInfo) (*subscription, error) {
+	if si.Workers == 0 {
+		si.Workers = 1
+	}
+	if si.Key == "" && len(si.Keys) == 0 && len(si.Routes) == 0 {
+		si.Key = si.keyName()
+	}
+
+	s := &subscription{
+		c:     c,
+		si:    &si,
+		stop:  make(chan struct{}),
+		ready: make(chan struct{}),
+	}
+
+	c.subsLock.Lock()
+	if _, ok := c.subs[si.Queue]; ok {
+		c.subsLock.Unlock()
+		return nil, fmt.Errorf("amqp_kit: duplicate queue entry: '%s' ", si.Queue)
+	}
+	if c.subs == nil {
+		c.subs = make(map[string]*subscription)
+	}
+	c.subs[si.Queue] = s
+	c.subsLock.Unlock()
+
+	s.workers.Add(si.Workers)
+	for i := 0; i < si.Workers; i++ {
+		go s.run()
+	}
+
+	return s, nil
+}
+
+func (c *Client) waitWorkerDuration() time.Duration {
+	if c.config.WaitWorkerDuration == 0 {
+		return defaultWaitWorkerDuration
+	}
+	return c.config.WaitWorkerDuration
+}
+
+// run starts a consumer again after its channel is closed
+func (s *subscription) run() {
+	defer s.workers.Done()
+
+	si := s.si
+	var (
+		once sync.Once
+		// started is set once the worker has started a consumer, later consumers are restored
+		started bool
+	)
+	ready := func() {
+		started = true
+		once.Do(s.workerStarted)
+	}
+
+	for {
+		select {
+		case <-s.c.stopClientChan:
+			log.Errorf(`stop client chan receiver for q: %s, n: %s, sub_exchange: %s`, si.Queue,
+				si.Name, si.Exchange)
+			return
+		case <-s.stop:
+			return
+		default:
+			// consumers cancelled by Shutdown are not started again
+			if s.c.isDraining() {
+				return
+			}
+			if err := s.c.receive(s, started, ready); err != nil {
+				log.Errorf(`Receive for q: %s, name: %s, err: %s`, si.Queue, si.Name, err)
+				s.setErr(err)
+			}
+		}
+
+		select {
+		case <-s.c.stopClientChan:
+		case <-s.stop:
+		case <-time.After(1 * time.Second):
+		}
+	}
+}
+
+func (s *subscription) wait(timeout <-chan time.Time) error {
+	select {
+	case <-s.ready:
+		return nil
+	case <-timeout:
+		return fmt.Errorf(`worker wait timeout`)
+	}
+}
+
+// Cancel stops consumers, deliveries not handled yet are requeued
+func (s *subscription) Cancel(ctx context.Context) error {
+	s.stopOnce.Do(func() { close(s.stop) })
+	s.c.cancelConsumers(s)
+
+	done := make(chan struct{})
+	go func() {
+		s.workers.Wait()
+		s.c.removeSubscription(s)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Status returns the current state of consumers
+func (s *subscription) Status() SubscriptionStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	status := SubscriptionStatus{
+		Queue:     s.si.Queue,
+		Consumers: s.consumers,
+		Restarts:  s.restarts,
+		LastError: s.lastErr,
+	}
+
+	switch {
+	case s.stopped():
+		status.State = SubscriptionCancelled
+	case s.consumers == s.si.Workers:
+		status.State = SubscriptionActive
+	case s.started == s.si.Workers:
+		status.State = SubscriptionRestarting
+	default:
+		status.State = SubscriptionStarting
+	}
+
+	return status
+}
+
+func (s *subscription) stopped() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *subscription) workerStarted() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.started++
+	if s.started == s.si.Workers {
+		close(s.ready)
+	}
+}
+
+func (s *subscription) consumerStarted(restored bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.consumers++
+	if restored {
+		s.restarts++
+	}
+}
+
+func (s *subscription) consumerStopped() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.consumers--
+}
+
+func (s *subscription) setErr(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.lastErr = err
+}
+
+func (c *Client) removeSubscription(s *subscription) {
+	c.subsLock.Lock()
+	defer c.subsLock.Unlock()
+
+	if c.subs[s.si.Queue] == s {
+		delete(c.subs, s.si.Queue)
+	}
+}
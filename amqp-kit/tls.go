@@ -0,0 +1,31 @@
+package amqp_kit
+
+import (
+	"github.com/space307/go-utils/v3/amqp-kit/amqptls"
+	"github.com/streadway/amqp"
+)
+
+// TLSConfig struct contains settings of amqps connection, see amqptls.Config
+type TLSConfig = amqptls.Config
+
+// ExternalAuth is the EXTERNAL SASL mechanism, see amqptls.ExternalAuth
+type ExternalAuth = amqptls.ExternalAuth
+
+// DialConfig creates amqp.Config with TLS settings and EXTERNAL mechanism if external is set
+func DialConfig(t *TLSConfig, external bool) (amqp.Config, error) {
+	return amqptls.DialConfig(t, external)
+}
+
+// dial opens amqp connection to the node for the config
+func dial(c *Config, addr string) (AMQPConnection, error) {
+	cfg, err := DialConfig(c.TLS, c.ExternalAuth)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := amqp.DialConfig(makeNodeDsn(c, addr), cfg)
+	if err != nil {
+		return nil, err
+	}
+	return amqpConnection{conn}, nil
+}
@@ -0,0 +1,130 @@
+package amqp_kit
+
+import (
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// ExchangeInfo struct use for describe exchange declaration.
+// The zero value describes a durable topic exchange.
+// Kind is one of amqp.ExchangeDirect, amqp.ExchangeFanout, amqp.ExchangeTopic, amqp.ExchangeHeaders
+type ExchangeInfo struct {
+	Kind       string
+	Transient  bool
+	AutoDelete bool
+	Internal   bool
+	Args       amqp.Table
+}
+
+// QueueInfo struct use for describe queue declaration.
+// The zero value describes a durable queue without arguments.
+// Type is the x-queue-type argument, e.g. "classic" or "quorum"
+type QueueInfo struct {
+	Transient          bool
+	AutoDelete         bool
+	Exclusive          bool
+	MessageTTL         time.Duration
+	MaxLength          int
+	DeadLetterExchange string
+	DeadLetterKey      string
+	Type               string
+	Args               amqp.Table
+}
+
+func (ei *ExchangeInfo) kind() string {
+	if ei.Kind == "" {
+		return DefaultExchangeKind
+	}
+	return ei.Kind
+}
+
+func (qi *QueueInfo) args() amqp.Table {
+	args := amqp.Table{}
+	for k, v := range qi.Args {
+		args[k] = v
+	}
+
+	if qi.MessageTTL > 0 {
+		args["x-message-ttl"] = int64(qi.MessageTTL / time.Millisecond)
+	}
+	if qi.MaxLength > 0 {
+		args["x-max-length"] = int64(qi.MaxLength)
+	}
+	if qi.DeadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = qi.DeadLetterExchange
+	}
+	if qi.DeadLetterKey != "" {
+		args["x-dead-letter-routing-key"] = qi.DeadLetterKey
+	}
+	if qi.Type != "" {
+		args["x-queue-type"] = qi.Type
+	}
+
+	if len(args) == 0 {
+		return nil
+	}
+	return args
+}
+
+// DeclareExchange create exchange by given description, nil means ExchangeInfo zero value
+func DeclareExchange(ch AMQPChannel, exchange string, ei *ExchangeInfo) error {
+	if ei == nil {
+		ei = &ExchangeInfo{}
+	}
+
+	return ch.ExchangeDeclare(exchange, ei.kind(), !ei.Transient, ei.AutoDelete, ei.Internal, false, ei.Args)
+}
+
+// DeclareQueue create queue by given description, nil means QueueInfo zero value
+func DeclareQueue(ch AMQPChannel, queue string, qi *QueueInfo) error {
+	if qi == nil {
+		qi = &QueueInfo{}
+	}
+
+	_, err := ch.QueueDeclare(queue, !qi.Transient, qi.AutoDelete, qi.Exclusive, false, qi.args())
+	return err
+}
+
+// Binding is a binding of a queue by the routing key with arguments, e.g. x-match of a headers exchange
+type Binding struct {
+	Key  string
+	Args amqp.Table
+}
+
+// DeclareTopology create exchange and queue by given descriptions and bind the queue by every key
+func DeclareTopology(ch AMQPChannel, exchange string, ei *ExchangeInfo, queue string, qi *QueueInfo, keys []string, qos int) error {
+	bindings := make([]Binding, len(keys))
+	for i, key := range keys {
+		bindings[i] = Binding{Key: key}
+	}
+
+	return declareTopology(ch, exchange, ei, queue, qi, bindings, qos)
+}
+
+func declareTopology(ch AMQPChannel, exchange string, ei *ExchangeInfo, queue string, qi *QueueInfo, bindings []Binding, qos int) error {
+	if err := DeclareExchange(ch, exchange, ei); err != nil {
+		return err
+	}
+
+	if err := DeclareQueue(ch, queue, qi); err != nil {
+		return err
+	}
+
+	if err := ch.Qos(qos, 0, false); err != nil {
+		return err
+	}
+
+	return BindQueue(ch, exchange, queue, bindings)
+}
+
+// BindQueue binds the queue to the exchange by every binding
+func BindQueue(ch AMQPChannel, exchange, queue string, bindings []Binding) error {
+	for _, b := range bindings {
+		if err := ch.QueueBind(queue, b.Key, exchange, false, b.Args); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
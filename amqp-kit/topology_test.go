@@ -0,0 +1,131 @@
+package amqp_kit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestQueueInfoArgs(t *testing.T) {
+	qi := &QueueInfo{}
+	assert.Nil(t, qi.args())
+
+	qi = &QueueInfo{
+		MessageTTL:         time.Minute,
+		MaxLength:          100,
+		DeadLetterExchange: `dlx`,
+		DeadLetterKey:      `dead`,
+		Type:               `quorum`,
+		Args:               amqp.Table{"x-overflow": "reject-publish"},
+	}
+	assert.Equal(t, amqp.Table{
+		"x-message-ttl":             int64(60000),
+		"x-max-length":              int64(100),
+		"x-dead-letter-exchange":    `dlx`,
+		"x-dead-letter-routing-key": `dead`,
+		"x-queue-type":              `quorum`,
+		"x-overflow":                "reject-publish",
+	}, qi.args())
+}
+
+func TestSubscribeInfoBindingKeys(t *testing.T) {
+	si := &SubscribeInfo{Key: `a`, Keys: []string{`b`, `c`}}
+	assert.Equal(t, []string{`a`, `b`, `c`}, si.bindingKeys())
+
+	si.Routes = []Route{{Key: `order.*`}}
+	assert.Equal(t, []string{`a`, `b`, `c`, `order.*`}, si.bindingKeys())
+	assert.Equal(t, []string{`a`, `b`, `c`}, si.ownKeys())
+
+	si = &SubscribeInfo{Keys: []string{`b`}}
+	assert.Equal(t, []string{`b`}, si.bindingKeys())
+}
+
+func TestExchangeInfo(t *testing.T) {
+	cl := &Client{config: &Config{Exchanges: map[string]ExchangeInfo{`fan`: {Kind: amqp.ExchangeFanout}}}}
+
+	assert.Equal(t, amqp.ExchangeFanout, cl.exchangeInfo(`fan`, nil).kind())
+	assert.Equal(t, amqp.ExchangeDirect, cl.exchangeInfo(`fan`, &ExchangeInfo{Kind: amqp.ExchangeDirect}).kind())
+	assert.Equal(t, DefaultExchangeKind, cl.exchangeInfo(`other`, nil).kind())
+}
+
+type topologySuite struct {
+	suite.Suite
+}
+
+func TestTopologySuite(t *testing.T) {
+	suite.Run(t, new(topologySuite))
+}
+
+func (s *topologySuite) TestServeTopology() {
+	dec1 := make(chan *amqp.Delivery, 2)
+	dec2 := make(chan *amqp.Delivery, 1)
+
+	subs := []SubscribeInfo{
+		{
+			Queue:     `topology_keys`,
+			Keys:      []string{`topology.a`, `topology.b`},
+			Exchange:  `topology-direct`,
+			QueueInfo: &QueueInfo{MessageTTL: time.Minute, MaxLength: 10},
+			E: func(ctx context.Context, request interface{}) (response interface{}, err error) {
+				return nil, nil
+			},
+			Dec: func(i context.Context, delivery *amqp.Delivery) (request interface{}, err error) {
+				dec1 <- delivery
+				return nil, nil
+			},
+			Enc: EncodeNopResponse,
+			O:   []SubscriberOption{SubscriberAfter(SetAckAfterEndpoint(false))},
+		},
+		{
+			Queue:    `topology_fanout`,
+			Exchange: `topology-fanout`,
+			E: func(ctx context.Context, request interface{}) (response interface{}, err error) {
+				return nil, nil
+			},
+			Dec: func(i context.Context, delivery *amqp.Delivery) (request interface{}, err error) {
+				dec2 <- delivery
+				return nil, nil
+			},
+			Enc: EncodeNopResponse,
+			O:   []SubscriberOption{SubscriberAfter(SetAckAfterEndpoint(false))},
+		},
+	}
+
+	cl, err := New(&Config{
+		Address:  rabbitTestAddr,
+		User:     "guest",
+		Password: "guest",
+		Exchanges: map[string]ExchangeInfo{
+			`topology-direct`: {Kind: amqp.ExchangeDirect, AutoDelete: true},
+			`topology-fanout`: {Kind: amqp.ExchangeFanout, AutoDelete: true},
+		},
+	})
+	s.Require().NoError(err)
+	s.Require().NoError(cl.Serve(subs))
+
+	s.Require().NoError(cl.Publish(`topology-direct`, `topology.a`, ``, []byte(`a`)))
+	s.Require().NoError(cl.Publish(`topology-direct`, `topology.b`, ``, []byte(`b`)))
+	s.Require().NoError(cl.Publish(`topology-fanout`, `any.key`, ``, []byte(`c`)))
+
+	for _, body := range []string{`a`, `b`} {
+		select {
+		case d := <-dec1:
+			s.Equal(body, string(d.Body))
+		case <-time.After(5 * time.Second):
+			s.Fail("timeout. waiting answer on dec1")
+		}
+	}
+
+	select {
+	case d := <-dec2:
+		s.Equal(`c`, string(d.Body))
+	case <-time.After(5 * time.Second):
+		s.Fail("timeout. waiting answer on dec2")
+	}
+
+	s.Require().NoError(cl.Close())
+}
@@ -11,7 +11,16 @@ import (
 	"github.com/streadway/amqp"
 )
 
-const tagError = "error"
+const (
+	tagError   = "error"
+	tagOutcome = "outcome"
+	tagStage   = "stage"
+
+	stageDecode   = "decode"
+	stageEndpoint = "endpoint"
+	stageEncode   = "encode"
+	stagePanic    = "panic"
+)
 
 type amqpSpanCtx string
 
@@ -19,37 +28,123 @@ var amqpCtx amqpSpanCtx
 
 //publish message to AMQP with tracing and span context
 func (c *Client) PublishWithTracing(ctx context.Context, exchange, key, corID string, body []byte) (err error) {
-	span, _ := opentracing.StartSpanFromContext(ctx, `publish_key: `+key)
-	defer span.Finish()
-
-	ext.SpanKind.Set(span, ext.SpanKindProducerEnum)
-	span.SetTag("key", key)
-	span.SetTag("exchange", exchange)
-	span.SetTag("corID", corID)
-
 	pub := amqp.Publishing{
 		Headers:       amqp.Table{},
-		ContentType:   "application/json",
+		ContentType:   ContentTypeJSON,
 		CorrelationId: corID,
 		Body:          body,
 		DeliveryMode:  amqp.Persistent,
 	}
 
+	span := startPublishSpan(ctx, exchange, key, &pub)
+	defer span.Finish()
+
+	return c.send(ctx, exchange, key, &pub)
+}
+
+// startPublishSpan starts a producer span and injects its context into the message headers
+func startPublishSpan(ctx context.Context, exchange, key string, pub *amqp.Publishing) opentracing.Span {
+	span, _ := opentracing.StartSpanFromContext(ctx, `publish_key: `+key)
+
+	ext.SpanKind.Set(span, ext.SpanKindProducerEnum)
+	span.SetTag("key", key)
+	span.SetTag("exchange", exchange)
+	span.SetTag("corID", pub.CorrelationId)
+
 	// Inject the span context into the AMQP header.
 	if err := amqptracer.Inject(span, pub.Headers); err != nil {
 		log.Printf("publish: error inject headers: %s", err)
 	}
 
-	return c.send(exchange, key, &pub)
+	return span
+}
+
+// SubscriberTracing starts a consumer span for every delivery, the span is a child or a follower
+// of the span context in the message headers by ref, opentracing.ChildOfRef or opentracing.FollowsFromRef.
+// Decode, endpoint and encode errors are set as error and stage tags, the ack outcome as the outcome tag.
+// The span is set to the context and its context is injected into replies published by encoders.
+func SubscriberTracing(tracer opentracing.Tracer, ref opentracing.SpanReferenceType) SubscriberOption {
+	return func(s *Subscriber) {
+		s.tracer = tracer
+		s.spanRef = ref
+	}
+}
+
+// startConsumeSpan starts a consumer span referencing the span context of the message headers
+func (s Subscriber) startConsumeSpan(d *amqp.Delivery) opentracing.Span {
+	var opts []opentracing.StartSpanOption
+	if spCtx, err := s.tracer.Extract(opentracing.TextMap, headersCarrier(d.Headers)); err == nil {
+		opts = append(opts, opentracing.SpanReference{Type: s.spanRef, ReferencedContext: spCtx})
+	}
+
+	span := s.tracer.StartSpan(`consume_key: `+d.RoutingKey, opts...)
+	ext.SpanKind.Set(span, ext.SpanKindConsumerEnum)
+	span.SetTag("key", d.RoutingKey)
+	span.SetTag("exchange", d.Exchange)
+	span.SetTag("corID", d.CorrelationId)
+	if s.queue != "" {
+		span.SetTag("queue", s.queue)
+	}
+
+	return span
+}
+
+// tracingChannel injects the span context into published replies
+type tracingChannel struct {
+	Channel
+	tracer opentracing.Tracer
+	span   opentracing.Span
+}
+
+func (c *tracingChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	headers := make(amqp.Table, len(msg.Headers)+1)
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	if err := c.tracer.Inject(c.span.Context(), opentracing.TextMap, headersCarrier(headers)); err != nil {
+		log.Printf("reply: error inject headers: %s", err)
+	}
+	msg.Headers = headers
+
+	return c.Channel.Publish(exchange, key, mandatory, immediate, msg)
+}
+
+// headersCarrier is a TextMap carrier of message headers
+type headersCarrier amqp.Table
+
+// ForeachKey calls handler for every string header
+func (c headersCarrier) ForeachKey(handler func(key, val string) error) error {
+	for k, v := range c {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		if err := handler(k, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Set sets the header
+func (c headersCarrier) Set(key, val string) {
+	c[key] = val
 }
 
 // Get context value spanContext and start Span with given operationName.
+// A span started by SubscriberTracing is the parent if set.
 // Set an error as tag if raised.
 func TraceEndpoint(tracer opentracing.Tracer, operationName string) endpoint.Middleware {
 	return func(next endpoint.Endpoint) endpoint.Endpoint {
 		return func(ctx context.Context, request interface{}) (interface{}, error) {
 			var sp opentracing.Span
-			if spCtx, ok := ctx.Value(amqpCtx).(*opentracing.SpanContext); ok {
+			if parent := opentracing.SpanFromContext(ctx); parent != nil {
+				sp = tracer.StartSpan(operationName, opentracing.ChildOf(parent.Context()))
+				defer sp.Finish()
+
+				ext.SpanKindRPCServer.Set(sp)
+				ctx = opentracing.ContextWithSpan(ctx, sp)
+			} else if spCtx, ok := ctx.Value(amqpCtx).(*opentracing.SpanContext); ok {
 				sp = tracer.StartSpan(operationName, opentracing.FollowsFrom(*spCtx))
 				defer sp.Finish()
 
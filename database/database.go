@@ -138,6 +138,11 @@ func (extDb *Database) GetConfig() *Config {
 	return extDb.config
 }
 
+// GetDriver get database driver name
+func (extDb *Database) GetDriver() string {
+	return extDb.driver
+}
+
 // Reconnect safely function which implements loop connection logic
 func (extDb *Database) Reconnect() error {
 	if atomic.LoadInt32(&extDb.isReady) == cDatabaseStateReconnect {
@@ -3,6 +3,7 @@ package messagebus
 import (
 	"net/url"
 
+	"github.com/space307/go-utils/v3/amqp-kit/amqptls"
 	"github.com/streadway/amqp"
 )
 
@@ -30,10 +31,12 @@ type MessageBus struct {
 }
 
 type Config struct {
-	Address     string //host:port
-	User        string
-	Password    string
-	VirtualHost string
+	Address      string //host:port
+	User         string
+	Password     string
+	VirtualHost  string
+	TLS          *amqptls.Config // enables amqps
+	ExternalAuth bool            // EXTERNAL SASL mechanism instead of User and Password
 }
 
 // Dial initialize connection to amqp
@@ -43,6 +46,25 @@ func Dial(dsn string) (*MessageBus, error) {
 		return nil, err
 	}
 
+	return open(conn)
+}
+
+// DialConfig initialize connection to amqp with TLS and auth settings of config
+func DialConfig(c *Config) (*MessageBus, error) {
+	cfg, err := amqptls.DialConfig(c.TLS, c.ExternalAuth)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := amqp.DialConfig(MakeDsn(c), cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return open(conn)
+}
+
+func open(conn *amqp.Connection) (*MessageBus, error) {
 	ch, err := conn.Channel()
 	if err != nil {
 		return nil, err
@@ -65,6 +87,12 @@ func MakeDsn(c *Config) string {
 		Host:   c.Address,
 		Path:   "/" + c.VirtualHost,
 	}
+	if c.TLS != nil {
+		urlStruct.Scheme = "amqps"
+	}
+	if c.ExternalAuth {
+		urlStruct.User = nil
+	}
 
 	return urlStruct.String()
 }